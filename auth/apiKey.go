@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"online-learning-golang/models"
+	"online-learning-golang/utils"
+)
+
+const (
+	// APIKeyPrefix starts every API key, so keys can be told apart from JWTs
+	// and found by secret scanners.
+	APIKeyPrefix = "olk_"
+	// MaxAPIKeysPerUser is how many active keys a user can have at once.
+	MaxAPIKeysPerUser = 20
+	// DefaultAPIKeyLifetime applies when no expiry is asked for.
+	DefaultAPIKeyLifetime = 90 * 24 * time.Hour
+	// MaxAPIKeyLifetimeDays is the longest an API key can be valid.
+	MaxAPIKeyLifetimeDays = 365
+
+	// apiKeyDisplayLength is how much of a key is kept in clear text so
+	// users can recognise it in the list.
+	apiKeyDisplayLength = len(APIKeyPrefix) + 8
+	// apiKeyTouchInterval limits how often last use is written to the
+	// database for a busy key.
+	apiKeyTouchInterval = time.Minute
+)
+
+// API key scopes. Read allows safe requests, write allows requests that
+// change data, and admin allows admin-only endpoints for admins.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// APIKeyScopes lists the valid scopes.
+var APIKeyScopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+var (
+	ErrInvalidAPIKey      = errors.New("invalid, expired or revoked API key")
+	ErrInvalidAPIKeyScope = errors.New("invalid API key scope")
+	ErrTooManyAPIKeys     = errors.New("too many active API keys")
+	ErrAPIKeyNotFound     = errors.New("API key not found")
+)
+
+// APIKeyIdentity is who a request authenticated with an API key acts as.
+type APIKeyIdentity struct {
+	KeyID  int
+	UserID int
+	Role   string
+	Scopes []string
+}
+
+// HasScope reports whether the key was granted the scope.
+func (k *APIKeyIdentity) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey reports whether a bearer credential is an API key rather than a
+// JWT.
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// RequiredScope is the scope a request with the method needs.
+func RequiredScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeRead
+	default:
+		return ScopeWrite
+	}
+}
+
+// NormalizeAPIKeyScopes checks the scopes and removes duplicates.
+func NormalizeAPIKeyScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, ErrInvalidAPIKeyScope
+	}
+
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		valid := false
+		for _, s := range APIKeyScopes {
+			valid = valid || s == scope
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAPIKeyScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, nil
+}
+
+// CreateAPIKey stores a new API key for the user and returns it. This is the
+// only time the key is available in clear text.
+func CreateAPIKey(db *sql.DB, userID int, name string, scopes []string, expiresAt time.Time) (string, models.APIKey, error) {
+	random, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key := APIKeyPrefix + random
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the user so concurrent requests cannot both pass the limit
+	var locked int
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&locked); err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to lock user: %w", err)
+	}
+
+	var active int
+	err = tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM api_keys
+		WHERE userId = ? AND revokedAt IS NULL AND expiresAt > ?
+	`, userID, time.Now()).Scan(&active)
+	if err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to count API keys: %w", err)
+	}
+	if active >= MaxAPIKeysPerUser {
+		return "", models.APIKey{}, ErrTooManyAPIKeys
+	}
+
+	now := time.Now()
+	result, err := tx.Exec(`
+		INSERT INTO api_keys (userId, name, prefix, keyHash, scopes, expiresAt, createdAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, name, key[:apiKeyDisplayLength], HashToken(key), strings.Join(scopes, ","), expiresAt, now)
+	if err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to get API key ID: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", models.APIKey{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return key, models.APIKey{
+		ID:        int(id),
+		Name:      name,
+		Prefix:    key[:apiKeyDisplayLength],
+		Scopes:    scopes,
+		CreatedAt: formatTimestamp(now),
+		ExpiresAt: formatTimestamp(expiresAt),
+	}, nil
+}
+
+// GetAPIKeys lists the user's active API keys, newest first.
+func GetAPIKeys(db *sql.DB, userID int) ([]models.APIKey, error) {
+	rows, err := db.Query(`
+		SELECT id, name, prefix, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIp
+		FROM api_keys
+		WHERE userId = ? AND revokedAt IS NULL AND expiresAt > ?
+		ORDER BY createdAt DESC, id DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var k models.APIKey
+		var scopes string
+		var createdAt, expiresAt time.Time
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &createdAt, &expiresAt, &lastUsedAt, &k.LastUsedIP); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		k.Scopes = strings.Split(scopes, ",")
+		k.CreatedAt = formatTimestamp(createdAt)
+		k.ExpiresAt = formatTimestamp(expiresAt)
+		if lastUsedAt.Valid {
+			used := formatTimestamp(lastUsedAt.Time)
+			k.LastUsedAt = &used
+		}
+		keys = append(keys, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the user's active API keys.
+func RevokeAPIKey(db *sql.DB, userID, keyID int) error {
+	result, err := db.Exec(`
+		UPDATE api_keys
+		SET revokedAt = ?
+		WHERE id = ? AND userId = ? AND revokedAt IS NULL
+	`, time.Now(), keyID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if revoked, _ := result.RowsAffected(); revoked == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// RevokeUserAPIKeys revokes every API key of the user.
+func RevokeUserAPIKeys(db execer, userID int) error {
+	_, err := db.Exec("UPDATE api_keys SET revokedAt = ? WHERE userId = ? AND revokedAt IS NULL", time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API keys: %w", err)
+	}
+	return nil
+}
+
+// AuthenticateAPIKey looks up an active API key of a user who has not been
+// deleted, and records that it was used.
+func AuthenticateAPIKey(db *sql.DB, key, ipAddress string) (*APIKeyIdentity, error) {
+	var identity APIKeyIdentity
+	var scopes string
+	var lastUsedAt sql.NullTime
+	now := time.Now()
+	err := db.QueryRow(`
+		SELECT k.id, k.userId, u.role, k.scopes, k.lastUsedAt
+		FROM api_keys k
+		JOIN users u ON u.id = k.userId
+		WHERE k.keyHash = ? AND k.revokedAt IS NULL AND k.expiresAt > ? AND u.deletedAt IS NULL
+	`, HashToken(key), now).Scan(&identity.KeyID, &identity.UserID, &identity.Role, &scopes, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check API key: %w", err)
+	}
+	identity.Scopes = strings.Split(scopes, ",")
+
+	if len(ipAddress) > 45 {
+		ipAddress = ipAddress[:45]
+	}
+	if !lastUsedAt.Valid || now.Sub(lastUsedAt.Time) > apiKeyTouchInterval {
+		_, err = db.Exec("UPDATE api_keys SET lastUsedAt = ?, lastUsedIp = ? WHERE id = ?", now, ipAddress, identity.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record API key use: %w", err)
+		}
+	}
+
+	return &identity, nil
+}
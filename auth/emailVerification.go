@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"online-learning-golang/utils"
+)
+
+const (
+	// EmailVerificationTTL is how long a verification link works.
+	EmailVerificationTTL = 24 * time.Hour
+	// Resends are throttled to one per interval and a few per hour, so the
+	// endpoint cannot be used to flood someone's inbox.
+	VerificationResendInterval = time.Minute
+	MaxVerificationsPerHour    = 5
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	ErrEmailAlreadyVerified     = errors.New("email is already verified")
+	ErrVerificationThrottled    = errors.New("verification email was sent recently, try again later")
+)
+
+// VerificationPolicy says what an account cannot do until its email address
+// has been verified. It is set with EMAIL_VERIFICATION.
+type VerificationPolicy string
+
+const (
+	// VerifyNone lets unverified accounts do everything.
+	VerifyNone VerificationPolicy = "none"
+	// VerifyCourse keeps courses from being activated for unverified accounts.
+	VerifyCourse VerificationPolicy = "course"
+	// VerifyLogin also keeps unverified accounts from logging in.
+	VerifyLogin VerificationPolicy = "login"
+)
+
+func EmailVerificationPolicy() VerificationPolicy {
+	switch policy := VerificationPolicy(os.Getenv("EMAIL_VERIFICATION")); policy {
+	case VerifyCourse, VerifyLogin:
+		return policy
+	default:
+		return VerifyNone
+	}
+}
+
+// VerificationRequiredForLogin reports whether unverified accounts are kept
+// from logging in.
+func VerificationRequiredForLogin() bool {
+	return EmailVerificationPolicy() == VerifyLogin
+}
+
+// VerificationRequiredForCourses reports whether courses can only be
+// activated for verified accounts.
+func VerificationRequiredForCourses() bool {
+	policy := EmailVerificationPolicy()
+	return policy == VerifyCourse || policy == VerifyLogin
+}
+
+// IssueEmailVerification stores a new verification token for the user and
+// returns it, to be mailed with utils.SendVerificationEmail. Earlier tokens
+// stay valid until they expire.
+func IssueEmailVerification(db execer, userID int) (string, error) {
+	token, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO email_verification_tokens (userId, token, expiry)
+		VALUES (?, ?, ?)
+	`, userID, token, time.Now().Add(EmailVerificationTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store verification token: %w", err)
+	}
+
+	return token, nil
+}
+
+// ResendEmailVerification issues a new verification token for the account
+// with the given email, unless it is verified already or one was issued too
+// recently.
+func ResendEmailVerification(db *sql.DB, email string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var verifiedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, emailVerifiedAt
+		FROM users
+		WHERE LOWER(email) = LOWER(?) AND deletedAt IS NULL
+		FOR UPDATE
+	`, email).Scan(&userID, &verifiedAt)
+	if err != nil {
+		return "", err
+	}
+	if verifiedAt.Valid {
+		return "", ErrEmailAlreadyVerified
+	}
+
+	var sentLastHour int
+	var lastSentAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT COUNT(*), MAX(createdAt)
+		FROM email_verification_tokens
+		WHERE userId = ? AND createdAt > ?
+	`, userID, time.Now().Add(-time.Hour)).Scan(&sentLastHour, &lastSentAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to check verification tokens: %w", err)
+	}
+	if sentLastHour >= MaxVerificationsPerHour || (lastSentAt.Valid && time.Since(lastSentAt.Time) < VerificationResendInterval) {
+		return "", ErrVerificationThrottled
+	}
+
+	token, err := IssueEmailVerification(tx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// VerifyEmail marks the address a token was sent to as verified and
+// invalidates the user's verification tokens.
+func VerifyEmail(db *sql.DB, token string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var expiry time.Time
+	err = tx.QueryRow(`
+		SELECT userId, expiry
+		FROM email_verification_tokens
+		WHERE token = ?
+	`, token).Scan(&userID, &expiry)
+	if err == sql.ErrNoRows {
+		return ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch verification token: %w", err)
+	}
+	if time.Now().After(expiry) {
+		return ErrInvalidVerificationToken
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET emailVerifiedAt = COALESCE(emailVerifiedAt, ?)
+		WHERE id = ? AND deletedAt IS NULL
+	`, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM email_verification_tokens WHERE userId = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate verification tokens: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"online-learning-golang/utils"
+)
+
+// MagicLinkTTL is how long the link in a login email works.
+const MagicLinkTTL = 15 * time.Minute
+
+var ErrInvalidMagicLink = errors.New("invalid or expired login link")
+
+// IssueMagicLink stores a single-use login token for the user, to be mailed
+// with utils.SendMagicLinkEmail. Earlier links of the user stop working.
+func IssueMagicLink(db *sql.DB, userID int) (string, error) {
+	token, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate login token: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM magic_link_tokens WHERE userId = ?", userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to clear login tokens: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO magic_link_tokens (userId, token, expiry)
+		VALUES (?, ?, ?)
+	`, userID, token, time.Now().Add(MagicLinkTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store login token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// RedeemMagicLink uses up a login token and returns the user it was sent to.
+// Following the link proves the user reads that mailbox, so it also verifies
+// their email address.
+func RedeemMagicLink(db *sql.DB, token string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var expiry time.Time
+	err = tx.QueryRow(`
+		SELECT t.userId, t.expiry
+		FROM magic_link_tokens t
+		JOIN users u ON u.id = t.userId
+		WHERE t.token = ? AND u.deletedAt IS NULL
+		FOR UPDATE
+	`, token).Scan(&userID, &expiry)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch login token: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM magic_link_tokens WHERE userId = ?", userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to invalidate login token: %w", err)
+	}
+
+	if time.Now().After(expiry) {
+		// Commit anyway so the expired token is cleaned up
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return 0, ErrInvalidMagicLink
+	}
+
+	_, err = tx.Exec("UPDATE users SET emailVerifiedAt = COALESCE(emailVerifiedAt, ?) WHERE id = ?", time.Now(), userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return userID, nil
+}
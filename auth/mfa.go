@@ -0,0 +1,320 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// RecoveryCodeCount is how many single-use recovery codes a user gets.
+const RecoveryCodeCount = 10
+
+var (
+	ErrMFAAlreadyEnabled  = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled      = errors.New("two-factor authentication is not enabled")
+	ErrMFASetupNotStarted = errors.New("two-factor authentication setup has not been started")
+	ErrInvalidMFACode     = errors.New("invalid authentication code")
+	ErrTooManyMFAAttempts = errors.New("too many invalid authentication codes")
+	ErrMFATokenUsed       = errors.New("MFA token has already been used")
+)
+
+// MFARequired reports whether users with the role must use two-factor
+// authentication. MFA_REQUIRED_FOR_ADMINS makes it mandatory for admins.
+func MFARequired(role string) bool {
+	return role == "admin" && os.Getenv("MFA_REQUIRED_FOR_ADMINS") == "true"
+}
+
+// MFAIssuer is the name authenticator apps show next to the account.
+func MFAIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Online Learning"
+}
+
+// MFAEnabled reports whether the user has confirmed a TOTP authenticator.
+func MFAEnabled(db *sql.DB, userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM user_mfa WHERE userId = ? AND enabledAt IS NOT NULL", userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to check two-factor authentication: %w", err)
+	}
+	return enabled, nil
+}
+
+// StartMFASetup generates a new TOTP secret for the user. It is not used for
+// logins until ConfirmMFASetup proves the authenticator app has it.
+func StartMFASetup(db *sql.DB, userID int) (string, error) {
+	enabled, err := MFAEnabled(db, userID)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", ErrMFAAlreadyEnabled
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_mfa (userId, secret)
+		VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), lastUsedStep = 0
+	`, userID, secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to store secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+// ConfirmMFASetup enables two-factor authentication once the user enters a
+// code from their app, and returns their recovery codes.
+func ConfirmMFASetup(db *sql.DB, userID int, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var enabledAt sql.NullTime
+	var lastUsedStep int64
+	err = tx.QueryRow(`
+		SELECT secret, enabledAt, lastUsedStep
+		FROM user_mfa
+		WHERE userId = ?
+		FOR UPDATE
+	`, userID).Scan(&secret, &enabledAt, &lastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrMFASetupNotStarted
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch secret: %w", err)
+	}
+	if enabledAt.Valid {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, ok := validateTOTP(secret, code, time.Now(), lastUsedStep)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	_, err = tx.Exec("UPDATE user_mfa SET enabledAt = ?, lastUsedStep = ? WHERE userId = ?", time.Now(), step, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return codes, nil
+}
+
+// VerifyMFACode accepts either a current TOTP code or an unused recovery
+// code. Each code works once. Wrong codes are counted per user under
+// MFAPolicy, which a new login does not reset, so knowing the password does
+// not buy more guesses.
+func VerifyMFACode(db *sql.DB, userID int, code string) error {
+	return verifyMFACodeWith(db, userID, code, nil)
+}
+
+// VerifyMFALogin checks the code of a login's second step like
+// VerifyMFACode, and redeems the login's MFA token in the same transaction,
+// so that the token completes at most one login. A token that was used
+// already is refused before the code is looked at: the replay neither uses
+// up the code nor counts as a wrong one. After a wrong code the token can be
+// tried again.
+func VerifyMFALogin(db *sql.DB, userID int, code, tokenID string, expiresAt time.Time) error {
+	_, err := db.Exec("DELETE FROM used_mfa_tokens WHERE expiresAt < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to clear used MFA tokens: %w", err)
+	}
+
+	return verifyMFACodeWith(db, userID, code, func(tx *sql.Tx) error {
+		return redeemMFAToken(tx, tokenID, expiresAt)
+	})
+}
+
+// verifyMFACodeWith checks the code after before, which runs in the same
+// transaction and can refuse the attempt without it counting.
+func verifyMFACodeWith(db *sql.DB, userID int, code string, before func(*sql.Tx) error) error {
+	attempt, err := BeginThrottledAttempt(db, MFAPolicy, UserThrottleKey(MFAPolicy, userID))
+	if err != nil {
+		return err
+	}
+	defer attempt.Release()
+	if attempt.RetryAfter() > 0 {
+		return ErrTooManyMFAAttempts
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if before != nil {
+		if err := before(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyMFACode(tx, userID, code); err != nil {
+		if err == ErrInvalidMFACode {
+			if _, recordErr := attempt.Record(); recordErr != nil {
+				return recordErr
+			}
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return attempt.Reset()
+}
+
+func verifyMFACode(tx *sql.Tx, userID int, code string) error {
+	var secret string
+	var lastUsedStep int64
+	err := tx.QueryRow(`
+		SELECT secret, lastUsedStep
+		FROM user_mfa
+		WHERE userId = ? AND enabledAt IS NOT NULL
+		FOR UPDATE
+	`, userID).Scan(&secret, &lastUsedStep)
+	if err == sql.ErrNoRows {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch secret: %w", err)
+	}
+
+	if step, ok := validateTOTP(secret, code, time.Now(), lastUsedStep); ok {
+		_, err = tx.Exec("UPDATE user_mfa SET lastUsedStep = ? WHERE userId = ?", step, userID)
+		if err != nil {
+			return fmt.Errorf("failed to record code use: %w", err)
+		}
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		UPDATE mfa_recovery_codes
+		SET usedAt = ?
+		WHERE userId = ? AND codeHash = ? AND usedAt IS NULL
+	`, time.Now(), userID, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return fmt.Errorf("failed to check recovery code: %w", err)
+	}
+	if used, _ := result.RowsAffected(); used > 0 {
+		return nil
+	}
+	return ErrInvalidMFACode
+}
+
+// redeemMFAToken marks an MFA token as used, by its ID. Entries are kept
+// until the token would have expired.
+func redeemMFAToken(tx *sql.Tx, tokenID string, expiresAt time.Time) error {
+	result, err := tx.Exec("INSERT IGNORE INTO used_mfa_tokens (tokenId, expiresAt) VALUES (?, ?)", tokenID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to record MFA token use: %w", err)
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return ErrMFATokenUsed
+	}
+	return nil
+}
+
+// DisableMFA turns two-factor authentication off after checking a code.
+func DisableMFA(db *sql.DB, userID int, code string) error {
+	if err := VerifyMFACode(db, userID, code); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("DELETE FROM user_mfa WHERE userId = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	_, err = db.Exec("DELETE FROM mfa_recovery_codes WHERE userId = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a code.
+func RegenerateRecoveryCodes(db *sql.DB, userID int, code string) ([]string, error) {
+	if err := VerifyMFACode(db, userID, code); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets users type codes without the dash or in upper
+// case.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func replaceRecoveryCodes(db execer, userID int) ([]string, error) {
+	_, err := db.Exec("DELETE FROM mfa_recovery_codes WHERE userId = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := hex.EncodeToString(raw)
+		codes[i] = code[:5] + "-" + code[5:]
+
+		_, err = db.Exec("INSERT INTO mfa_recovery_codes (userId, codeHash) VALUES (?, ?)", userID, HashToken(code))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	return codes, nil
+}
+
+// RecoveryCodesLeft counts the user's unused recovery codes.
+func RecoveryCodesLeft(db *sql.DB, userID int) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM mfa_recovery_codes WHERE userId = ? AND usedAt IS NULL", userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"online-learning-golang/utils"
+)
+
+// OIDCLoginTTL is how long the user has to finish signing in with the
+// provider.
+const OIDCLoginTTL = 10 * time.Minute
+
+var ErrInvalidOIDCState = errors.New("invalid or expired login state")
+
+// OIDCLoginState is what the server keeps of a login between
+// BeginOIDCLogin and FinishOIDCLogin.
+type OIDCLoginState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// OIDCStateStore holds the states of logins in progress.
+type OIDCStateStore interface {
+	// Save keeps the login under its state.
+	Save(state string, login OIDCLoginState) error
+	// Take removes the provider's login with the state and returns it, or
+	// ErrInvalidOIDCState if there is none.
+	Take(state, provider string) (OIDCLoginState, error)
+}
+
+// dbOIDCStateStore keeps login states in the oidc_login_states table, so
+// the callback can reach any server instance.
+type dbOIDCStateStore struct {
+	db *sql.DB
+}
+
+// NewOIDCStateStore returns a store backed by the oidc_login_states table.
+func NewOIDCStateStore(db *sql.DB) OIDCStateStore {
+	return &dbOIDCStateStore{db: db}
+}
+
+func (s *dbOIDCStateStore) Save(state string, login OIDCLoginState) error {
+	_, err := s.db.Exec("DELETE FROM oidc_login_states WHERE expiresAt < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to clean up login states: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO oidc_login_states (state, provider, nonce, codeVerifier, expiresAt)
+		VALUES (?, ?, ?, ?, ?)
+	`, state, login.Provider, login.Nonce, login.CodeVerifier, login.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to store login state: %w", err)
+	}
+	return nil
+}
+
+func (s *dbOIDCStateStore) Take(state, provider string) (OIDCLoginState, error) {
+	login := OIDCLoginState{Provider: provider}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return login, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		SELECT nonce, codeVerifier, expiresAt
+		FROM oidc_login_states
+		WHERE state = ? AND provider = ?
+		FOR UPDATE
+	`, state, provider).Scan(&login.Nonce, &login.CodeVerifier, &login.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return login, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return login, fmt.Errorf("failed to fetch login state: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM oidc_login_states WHERE state = ?", state); err != nil {
+		return login, fmt.Errorf("failed to redeem login state: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return login, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return login, nil
+}
+
+// BeginOIDCLogin starts an authorization code flow with PKCE and returns the
+// provider URL to send the user to, and the state the provider will send
+// back. The nonce and code verifier stay on the server until the callback.
+func BeginOIDCLogin(store OIDCStateStore, provider *OIDCProvider) (string, string, error) {
+	state, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate state: %w", err)
+	}
+	nonce, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate code verifier: %w", err)
+	}
+	codeVerifier := base64.RawURLEncoding.EncodeToString(raw)
+
+	authURL, err := provider.AuthorizationURL(state, nonce, codeVerifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = store.Save(state, OIDCLoginState{
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().Add(OIDCLoginTTL),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return authURL, state, nil
+}
+
+// FinishOIDCLogin redeems the state of a login started with BeginOIDCLogin,
+// exchanges the code and returns the verified identity. Every state works
+// once.
+func FinishOIDCLogin(store OIDCStateStore, provider *OIDCProvider, code, state string) (*OIDCIdentity, error) {
+	login, err := store.Take(state, provider.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(login.ExpiresAt) {
+		return nil, ErrInvalidOIDCState
+	}
+	return provider.Exchange(code, login.CodeVerifier, login.Nonce)
+}
+
+// LinkedUserID returns the user an external identity is linked to.
+func LinkedUserID(db *sql.DB, identity *OIDCIdentity) (int, error) {
+	var userID int
+	err := db.QueryRow(`
+		SELECT i.userId
+		FROM user_identities i
+		JOIN users u ON u.id = i.userId
+		WHERE i.provider = ? AND i.subject = ? AND u.deletedAt IS NULL
+	`, identity.Provider, identity.Subject).Scan(&userID)
+	return userID, err
+}
+
+// LinkIdentity lets the user sign in with the external identity from now on.
+func LinkIdentity(db execer, userID int, identity *OIDCIdentity) error {
+	_, err := db.Exec(`
+		INSERT INTO user_identities (userId, provider, subject, email)
+		VALUES (?, ?, ?, ?)
+	`, userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	return nil
+}
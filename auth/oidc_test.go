@@ -0,0 +1,479 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testClientID    = "client"
+	testRedirectURL = "https://app.example/oidc/callback"
+	testKeyID       = "test-key"
+)
+
+// mockIssuer is a local OpenID provider serving discovery, its JWKS and a
+// token endpoint that checks the PKCE verifier against the challenge of the
+// authorization request.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	requests map[string]url.Values
+	// tokenRequests counts the calls to the token endpoint.
+	tokenRequests int
+	// claims changes the claims of the ID tokens issued, and signingKey, if
+	// set, signs them instead of the published key.
+	claims     func(jwt.MapClaims)
+	signingKey *rsa.PrivateKey
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	issuer := &mockIssuer{key: key, requests: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	return issuer
+}
+
+func (i *mockIssuer) provider(name string) *OIDCProvider {
+	return &OIDCProvider{
+		Name:        name,
+		Issuer:      i.URL,
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		Scopes:      []string{"openid", "email", "profile"},
+	}
+}
+
+func (i *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+func (i *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := base64.RawURLEncoding.EncodeToString
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": testKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(i.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize stands in for the user signing in at the authorization endpoint
+// and returns the code and state the provider redirects back with.
+func (i *mockIssuer) authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %v", err)
+	}
+	if !strings.HasPrefix(authURL, i.URL+"/authorize?") {
+		t.Fatalf("authorization URL %q is not the discovered endpoint", authURL)
+	}
+
+	query := parsed.Query()
+	for param, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"code_challenge_method": "S256",
+	} {
+		if got := query.Get(param); got != want {
+			t.Fatalf("%s = %q, want %q", param, got, want)
+		}
+	}
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if query.Get(param) == "" {
+			t.Fatalf("authorization request has no %s", param)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(i.requests))
+	i.requests[code] = query
+	return code, query.Get("state")
+}
+
+func (i *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.tokenRequests++
+
+	fail := func(description string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": description})
+	}
+
+	if err := r.ParseForm(); err != nil {
+		fail("malformed request")
+		return
+	}
+	request, ok := i.requests[r.PostForm.Get("code")]
+	if !ok {
+		fail("unknown code")
+		return
+	}
+	delete(i.requests, r.PostForm.Get("code"))
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		fail("unsupported grant")
+		return
+	case r.PostForm.Get("client_id") != testClientID:
+		fail("wrong client")
+		return
+	case r.PostForm.Get("redirect_uri") != request.Get("redirect_uri"):
+		fail("redirect_uri mismatch")
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != request.Get("code_challenge"):
+		fail("code_verifier does not match the code_challenge")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            i.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          request.Get("nonce"),
+		"email":          "Someone@Example.com",
+		"email_verified": true,
+		"name":           "Some One",
+	}
+	if i.claims != nil {
+		i.claims(claims)
+	}
+
+	key := i.key
+	if i.signingKey != nil {
+		key = i.signingKey
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = testKeyID
+	signed, err := idToken.SignedString(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": signed})
+}
+
+// issueWith changes how the next ID tokens are issued.
+func (i *mockIssuer) issueWith(claims func(jwt.MapClaims), signingKey *rsa.PrivateKey) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.claims = claims
+	i.signingKey = signingKey
+}
+
+func (i *mockIssuer) tokenRequestCount() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.tokenRequests
+}
+
+// login runs the whole flow: BeginOIDCLogin, the user signing in at the
+// issuer, and FinishOIDCLogin with what the issuer redirected back with.
+func (i *mockIssuer) login(t *testing.T, store OIDCStateStore, provider *OIDCProvider) (*OIDCIdentity, error) {
+	t.Helper()
+
+	authURL, _, err := BeginOIDCLogin(store, provider)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	code, state := i.authorize(t, authURL)
+	return FinishOIDCLogin(store, provider, code, state)
+}
+
+// memoryStateStore keeps login states in a map. The tests reach into it to
+// tamper with a login in progress.
+type memoryStateStore struct {
+	mu     sync.Mutex
+	logins map[string]*OIDCLoginState
+}
+
+func newMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{logins: make(map[string]*OIDCLoginState)}
+}
+
+func (s *memoryStateStore) Save(state string, login OIDCLoginState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins[state] = &login
+	return nil
+}
+
+func (s *memoryStateStore) Take(state, provider string) (OIDCLoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.logins[state]
+	if !ok || login.Provider != provider {
+		return OIDCLoginState{}, ErrInvalidOIDCState
+	}
+	delete(s.logins, state)
+	return *login, nil
+}
+
+// only returns the single login in progress.
+func (s *memoryStateStore) only(t *testing.T) *OIDCLoginState {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.logins) != 1 {
+		t.Fatalf("expected one login state, found %d", len(s.logins))
+	}
+	for _, login := range s.logins {
+		return login
+	}
+	return nil
+}
+
+func (s *memoryStateStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.logins)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider("mock")
+	states := newMemoryStateStore()
+
+	authURL, _, err := BeginOIDCLogin(states, provider)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	code, state := issuer.authorize(t, authURL)
+
+	// The verifier stays on the server, and the provider only sees its hash
+	stored := states.only(t)
+	if strings.Contains(authURL, stored.CodeVerifier) {
+		t.Error("authorization URL contains the code verifier")
+	}
+	if got := time.Until(stored.ExpiresAt); got <= 0 || got > OIDCLoginTTL {
+		t.Errorf("state expires in %v", got)
+	}
+
+	identity, err := FinishOIDCLogin(states, provider, code, state)
+	if err != nil {
+		t.Fatalf("failed to finish login: %v", err)
+	}
+	want := OIDCIdentity{
+		Provider:      "mock",
+		Subject:       "subject-1",
+		Email:         "someone@example.com",
+		EmailVerified: true,
+		Name:          "Some One",
+	}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+
+	// Every state works once
+	if _, err := FinishOIDCLogin(states, provider, code, state); err != ErrInvalidOIDCState {
+		t.Errorf("reused state: err = %v, want %v", err, ErrInvalidOIDCState)
+	}
+	if got := issuer.tokenRequestCount(); got != 1 {
+		t.Errorf("token endpoint called %d times, want 1", got)
+	}
+}
+
+func TestOIDCLoginChecksPKCEVerifier(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider("mock")
+	states := newMemoryStateStore()
+
+	authURL, _, err := BeginOIDCLogin(states, provider)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	code, state := issuer.authorize(t, authURL)
+
+	// Someone holding the code but not the verifier of this login
+	states.only(t).CodeVerifier = "intercepted-code-without-the-verifier-0123"
+
+	_, err = FinishOIDCLogin(states, provider, code, state)
+	if err == nil || err == ErrInvalidOIDCState {
+		t.Fatalf("err = %v, want the provider to reject the code", err)
+	}
+	if !strings.Contains(err.Error(), "code_verifier does not match") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOIDCLoginRejectsUnknownState(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider("mock")
+	states := newMemoryStateStore()
+
+	authURL, _, err := BeginOIDCLogin(states, provider)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	code, state := issuer.authorize(t, authURL)
+
+	if _, err := FinishOIDCLogin(states, provider, code, "not-the-state"); err != ErrInvalidOIDCState {
+		t.Errorf("unknown state: err = %v, want %v", err, ErrInvalidOIDCState)
+	}
+	if _, err := FinishOIDCLogin(states, issuer.provider("other"), code, state); err != ErrInvalidOIDCState {
+		t.Errorf("state of another provider: err = %v, want %v", err, ErrInvalidOIDCState)
+	}
+	if got := issuer.tokenRequestCount(); got != 0 {
+		t.Errorf("token endpoint called %d times without a valid state", got)
+	}
+
+	// The rejected attempts leave the real login alone
+	if _, err := FinishOIDCLogin(states, provider, code, state); err != nil {
+		t.Errorf("failed to finish login: %v", err)
+	}
+}
+
+func TestOIDCLoginRejectsExpiredState(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := issuer.provider("mock")
+	states := newMemoryStateStore()
+
+	authURL, _, err := BeginOIDCLogin(states, provider)
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	code, state := issuer.authorize(t, authURL)
+	states.only(t).ExpiresAt = time.Now().Add(-time.Second)
+
+	if _, err := FinishOIDCLogin(states, provider, code, state); err != ErrInvalidOIDCState {
+		t.Errorf("err = %v, want %v", err, ErrInvalidOIDCState)
+	}
+	if got := issuer.tokenRequestCount(); got != 0 {
+		t.Errorf("token endpoint called %d times for an expired state", got)
+	}
+	if got := states.count(); got != 0 {
+		t.Errorf("expired state was kept, %d states left", got)
+	}
+}
+
+func TestOIDCLoginVerifiesIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		claims func(jwt.MapClaims)
+		key    *rsa.PrivateKey
+		valid  bool
+	}{
+		{name: "valid", valid: true},
+		{name: "issuer with trailing slash", claims: func(c jwt.MapClaims) { c["iss"] = c["iss"].(string) + "/" }, valid: true},
+		{name: "client among audiences", claims: func(c jwt.MapClaims) { c["aud"] = []string{"another-client", testClientID} }, valid: true},
+		{name: "other nonce", claims: func(c jwt.MapClaims) { c["nonce"] = "replayed-nonce" }},
+		{name: "missing nonce", claims: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "other audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "missing audience", claims: func(c jwt.MapClaims) { delete(c, "aud") }},
+		{name: "other issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://issuer.example" }},
+		{name: "missing issuer", claims: func(c jwt.MapClaims) { delete(c, "iss") }},
+		{name: "expired", claims: func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		}},
+		{name: "missing expiry", claims: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "missing subject", claims: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "signed with another key", key: otherKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newMockIssuer(t)
+			issuer.issueWith(tt.claims, tt.key)
+			states := newMemoryStateStore()
+
+			identity, err := issuer.login(t, states, issuer.provider("mock"))
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("valid ID token rejected: %v", err)
+				}
+				if identity.Subject != "subject-1" {
+					t.Errorf("subject = %q", identity.Subject)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("err = %v, want %v", err, ErrInvalidIDToken)
+			}
+		})
+	}
+}
+
+func TestOIDCIdentityLinksOnlyVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(jwt.MapClaims)
+		want   bool
+	}{
+		{"verified", nil, true},
+		{"verified as a string", func(c jwt.MapClaims) { c["email_verified"] = "true" }, true},
+		{"unverified", func(c jwt.MapClaims) { c["email_verified"] = false }, false},
+		{"unverified as a string", func(c jwt.MapClaims) { c["email_verified"] = "false" }, false},
+		{"verification not shared", func(c jwt.MapClaims) { delete(c, "email_verified") }, false},
+		{"verified without an email", func(c jwt.MapClaims) { delete(c, "email") }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newMockIssuer(t)
+			issuer.issueWith(tt.claims, nil)
+			states := newMemoryStateStore()
+
+			identity, err := issuer.login(t, states, issuer.provider("mock"))
+			if err != nil {
+				t.Fatalf("failed to finish login: %v", err)
+			}
+			if got := identity.HasVerifiedEmail(); got != tt.want {
+				t.Errorf("HasVerifiedEmail = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
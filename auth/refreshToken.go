@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"online-learning-golang/utils"
+)
+
+// RefreshTokenTTL is how long a refresh token can be used. Each refresh
+// issues a new token with a fresh TTL.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused means an already rotated token was presented
+	// again, so it has probably been stolen. Its whole session is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is a newly issued refresh token. Only its hash is stored, so
+// the plain token is available once, here. All tokens rotated from the same
+// login form a family, which is the user's session.
+type RefreshToken struct {
+	Token     string
+	UserID    int
+	SessionID string
+	ExpiresIn int64
+}
+
+// HashToken returns the hex SHA-256 of a random token. Tokens are long and
+// random, so a fast hash is enough to make a leaked table useless.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertRefreshToken(db execer, userID int, sessionID string, expiresAt time.Time) (*RefreshToken, error) {
+	token, err := utils.GenerateResetToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO refresh_tokens (userId, familyId, tokenHash, expiresAt)
+		VALUES (?, ?, ?, ?)
+	`, userID, sessionID, HashToken(token), expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return &RefreshToken{
+		Token:     token,
+		UserID:    userID,
+		SessionID: sessionID,
+		ExpiresIn: int64(RefreshTokenTTL.Seconds()),
+	}, nil
+}
+
+// IssueRefreshToken starts a new session, i.e. a new login, and returns its
+// first refresh token.
+func IssueRefreshToken(db *sql.DB, userID int, client ClientInfo) (*RefreshToken, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Expired sessions are no use to anyone, clear them while we are here
+	_, err = tx.Exec("DELETE FROM user_sessions WHERE userId = ? AND expiresAt < ?", userID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up sessions: %w", err)
+	}
+
+	expiresAt := time.Now().Add(RefreshTokenTTL)
+	if err := insertSession(tx, sessionID, userID, client, expiresAt); err != nil {
+		return nil, err
+	}
+
+	token, err := insertRefreshToken(tx, userID, sessionID, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// session. Every token can be used once: presenting a rotated token again
+// revokes the session and returns ErrRefreshTokenReused.
+func RotateRefreshToken(db *sql.DB, token string, client ClientInfo) (*RefreshToken, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var sessionID string
+	var expiresAt time.Time
+	var rotatedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, userId, familyId, expiresAt, rotatedAt, revokedAt
+		FROM refresh_tokens
+		WHERE tokenHash = ?
+		FOR UPDATE
+	`, HashToken(token)).Scan(&id, &userID, &sessionID, &expiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch refresh token: %w", err)
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if rotatedAt.Valid {
+		if err := revokeSession(tx, sessionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET rotatedAt = ? WHERE id = ?", time.Now(), id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	nextExpiresAt := time.Now().Add(RefreshTokenTTL)
+	if err := touchSession(tx, sessionID, client, nextExpiresAt); err != nil {
+		return nil, err
+	}
+
+	next, err := insertRefreshToken(tx, userID, sessionID, nextExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return next, nil
+}
+
+// RevokeRefreshToken revokes the session a refresh token belongs to, ending
+// that login. Unknown tokens are ignored.
+func RevokeRefreshToken(db *sql.DB, token string) error {
+	var sessionID string
+	err := db.QueryRow("SELECT familyId FROM refresh_tokens WHERE tokenHash = ?", HashToken(token)).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch refresh token: %w", err)
+	}
+	return revokeSession(db, sessionID)
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"online-learning-golang/utils"
+)
+
+// ClientInfo describes the device a session was used from.
+type ClientInfo struct {
+	UserAgent string
+	IPAddress string
+}
+
+func (c ClientInfo) truncated() ClientInfo {
+	if len(c.UserAgent) > 255 {
+		c.UserAgent = c.UserAgent[:255]
+	}
+	if len(c.IPAddress) > 45 {
+		c.IPAddress = c.IPAddress[:45]
+	}
+	return c
+}
+
+// Session is one signed-in device. Access tokens carry its ID, so revoking
+// it signs the device out on its next request.
+type Session struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"userAgent"`
+	IPAddress  string `json:"ipAddress"`
+	CreatedAt  string `json:"createdAt"`
+	LastUsedAt string `json:"lastUsedAt"`
+	ExpiresAt  string `json:"expiresAt"`
+	Current    bool   `json:"current"`
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func newSessionID() (string, error) {
+	id, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", err
+	}
+	return id[:32], nil
+}
+
+func insertSession(db execer, sessionID string, userID int, client ClientInfo, expiresAt time.Time) error {
+	client = client.truncated()
+	_, err := db.Exec(`
+		INSERT INTO user_sessions (id, userId, userAgent, ipAddress, expiresAt)
+		VALUES (?, ?, ?, ?, ?)
+	`, sessionID, userID, client.UserAgent, client.IPAddress, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+// touchSession records that a session was just used to refresh.
+func touchSession(db execer, sessionID string, client ClientInfo, expiresAt time.Time) error {
+	client = client.truncated()
+	_, err := db.Exec(`
+		UPDATE user_sessions
+		SET userAgent = ?, ipAddress = ?, lastUsedAt = ?, expiresAt = ?
+		WHERE id = ?
+	`, client.UserAgent, client.IPAddress, time.Now(), expiresAt, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+func revokeSession(db execer, sessionID string) error {
+	now := time.Now()
+	_, err := db.Exec("UPDATE user_sessions SET revokedAt = ? WHERE id = ? AND revokedAt IS NULL", now, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	_, err = db.Exec("UPDATE refresh_tokens SET revokedAt = ? WHERE familyId = ? AND revokedAt IS NULL", now, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// SessionActive reports whether a session of the user exists and has been
+// neither revoked nor left to expire, and the user has not been deleted.
+func SessionActive(db *sql.DB, sessionID string, userID int) (bool, error) {
+	var active bool
+	err := db.QueryRow(`
+		SELECT COUNT(*) > 0
+		FROM user_sessions s
+		JOIN users u ON u.id = s.userId
+		WHERE s.id = ? AND s.userId = ? AND s.revokedAt IS NULL AND s.expiresAt > ? AND u.deletedAt IS NULL
+	`, sessionID, userID, time.Now()).Scan(&active)
+	if err != nil {
+		return false, fmt.Errorf("failed to check session: %w", err)
+	}
+	return active, nil
+}
+
+// GetSessions lists the active sessions of a user, most recently used first.
+// The one with currentID is flagged as the caller's own.
+func GetSessions(db *sql.DB, userID int, currentID string) ([]Session, error) {
+	rows, err := db.Query(`
+		SELECT id, userAgent, ipAddress, createdAt, lastUsedAt, expiresAt
+		FROM user_sessions
+		WHERE userId = ? AND revokedAt IS NULL AND expiresAt > ?
+		ORDER BY lastUsedAt DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var createdAt, lastUsedAt, expiresAt time.Time
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &createdAt, &lastUsedAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		s.CreatedAt = formatTimestamp(createdAt)
+		s.LastUsedAt = formatTimestamp(lastUsedAt)
+		s.ExpiresAt = formatTimestamp(expiresAt)
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession signs one of the user's sessions out. It reports false if
+// the user has no such active session.
+func RevokeSession(db *sql.DB, userID int, sessionID string) (bool, error) {
+	active, err := SessionActive(db, sessionID, userID)
+	if err != nil || !active {
+		return false, err
+	}
+	return true, revokeSession(db, sessionID)
+}
+
+// RevokeUserSessions signs a user out everywhere.
+func RevokeUserSessions(db execer, userID int) error {
+	now := time.Now()
+	_, err := db.Exec("UPDATE user_sessions SET revokedAt = ? WHERE userId = ? AND revokedAt IS NULL", now, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	_, err = db.Exec("UPDATE refresh_tokens SET revokedAt = ? WHERE userId = ? AND revokedAt IS NULL", now, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
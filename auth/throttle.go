@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ThrottlePolicy decides how quickly repeated attempts on one key, such as
+// an account or an IP address, are slowed down. The first FreeAttempts
+// attempts in a Window go through; after that every attempt doubles the wait,
+// from BaseDelay up to MaxDelay. With LockoutAfter set, that many attempts
+// lock the key for LockoutDuration.
+type ThrottlePolicy struct {
+	Name            string
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	Window          time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+}
+
+var (
+	// LoginAccountPolicy counts failed logins per account, or per identifier
+	// when no account matches so unknown names behave the same.
+	LoginAccountPolicy = ThrottlePolicy{
+		Name:            "login",
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		Window:          time.Hour,
+		LockoutAfter:    10,
+		LockoutDuration: 30 * time.Minute,
+	}
+	// MFAPolicy counts wrong second-factor codes per user. It is separate from
+	// LoginAccountPolicy and only a correct code resets it, so each new login
+	// continues where the last one stopped.
+	MFAPolicy = ThrottlePolicy{
+		Name:            "mfa",
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		Window:          time.Hour,
+		LockoutAfter:    10,
+		LockoutDuration: 30 * time.Minute,
+	}
+	// LoginIPPolicy counts failed logins per client IP, across accounts.
+	LoginIPPolicy = ThrottlePolicy{
+		Name:         "login-ip",
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+		Window:       time.Hour,
+	}
+	// ForgotPasswordEmailPolicy counts reset emails requested per address.
+	ForgotPasswordEmailPolicy = ThrottlePolicy{
+		Name:         "forgot-password",
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	// ForgotPasswordIPPolicy counts reset emails requested per client IP.
+	ForgotPasswordIPPolicy = ThrottlePolicy{
+		Name:         "forgot-password-ip",
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	// MagicLinkEmailPolicy counts login links requested per address.
+	MagicLinkEmailPolicy = ThrottlePolicy{
+		Name:         "magic-link",
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	// MagicLinkIPPolicy counts login links requested per client IP.
+	MagicLinkIPPolicy = ThrottlePolicy{
+		Name:         "magic-link-ip",
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	// VerificationEmailPolicy counts verification emails requested per
+	// address, whether or not an account uses it.
+	VerificationEmailPolicy = ThrottlePolicy{
+		Name:         "resend-verification",
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+	// VerificationIPPolicy counts verification emails requested per client IP.
+	VerificationIPPolicy = ThrottlePolicy{
+		Name:         "resend-verification-ip",
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+)
+
+// throttleState is what is stored per key.
+type throttleState struct {
+	Failures      int
+	LastFailureAt time.Time
+	BlockedUntil  time.Time
+}
+
+// retryAfter is how long the key has to wait before its next attempt.
+func (p ThrottlePolicy) retryAfter(s throttleState, now time.Time) time.Duration {
+	if s.BlockedUntil.After(now) {
+		return s.BlockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// next returns the state after one more failed attempt. Failures older than
+// the window are forgotten once any block has run out.
+func (p ThrottlePolicy) next(s throttleState, now time.Time) throttleState {
+	if !s.LastFailureAt.IsZero() && now.Sub(s.LastFailureAt) > p.Window && !s.BlockedUntil.After(now) {
+		s = throttleState{}
+	}
+
+	s.Failures++
+	s.LastFailureAt = now
+
+	if p.LockoutAfter > 0 && s.Failures >= p.LockoutAfter {
+		s.BlockedUntil = now.Add(p.LockoutDuration)
+		return s
+	}
+
+	if s.Failures > p.FreeAttempts {
+		delay := p.MaxDelay
+		if shift := s.Failures - p.FreeAttempts - 1; shift < 30 {
+			if d := p.BaseDelay << shift; d < p.MaxDelay {
+				delay = d
+			}
+		}
+		s.BlockedUntil = now.Add(delay)
+	}
+	return s
+}
+
+// expiresAt is when the state stops mattering: its failures have left the
+// window and any block has run out.
+func (p ThrottlePolicy) expiresAt(s throttleState) time.Time {
+	expiresAt := s.LastFailureAt.Add(p.Window)
+	if s.BlockedUntil.After(expiresAt) {
+		return s.BlockedUntil
+	}
+	return expiresAt
+}
+
+// locks reports whether reaching this state locked the key. Attempts made
+// after the lockout ran out lock it again, but only the first lockout in a
+// window counts as new.
+func (p ThrottlePolicy) locks(s throttleState) bool {
+	return p.LockoutAfter > 0 && s.Failures == p.LockoutAfter
+}
+
+// ThrottleKey builds the key an attempt is counted under. Free-form values
+// such as emails are hashed, so the table does not collect them.
+func ThrottleKey(policy ThrottlePolicy, kind, value string) string {
+	if kind != "user" && kind != "ip" {
+		value = HashToken(strings.ToLower(strings.TrimSpace(value)))
+	}
+	return policy.Name + ":" + kind + ":" + value
+}
+
+// UserThrottleKey is the key of an account under a policy.
+func UserThrottleKey(policy ThrottlePolicy, userID int) string {
+	return ThrottleKey(policy, "user", strconv.Itoa(userID))
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func loadThrottleState(db queryer, key string, forUpdate bool) (throttleState, error) {
+	query := "SELECT failures, lastFailureAt, blockedUntil FROM auth_throttles WHERE throttleKey = ?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var s throttleState
+	var blockedUntil sql.NullTime
+	err := db.QueryRow(query, key).Scan(&s.Failures, &s.LastFailureAt, &blockedUntil)
+	if err == sql.ErrNoRows {
+		return throttleState{}, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to load throttle state: %w", err)
+	}
+	s.BlockedUntil = blockedUntil.Time
+	return s, nil
+}
+
+// ThrottledAttempt keeps the throttle row of a key locked while an attempt
+// is checked. Parallel attempts on the key therefore wait for each other, and
+// each one sees the failures recorded before it, instead of all of them
+// passing the check before any is counted. It must be ended with Record,
+// Reset or Release.
+//
+// Only Record leaves a row behind, and rows are deleted once they expire, so
+// keys that never fail, or stopped failing, take no space.
+type ThrottledAttempt struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	policy ThrottlePolicy
+	key    string
+	state  throttleState
+	now    time.Time
+}
+
+// BeginThrottledAttempt locks the key for one attempt.
+func BeginThrottledAttempt(db *sql.DB, policy ThrottlePolicy, key string) (*ThrottledAttempt, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	// A key without failures gets a placeholder row, so that there is a row
+	// to lock. It is only committed if Record counts a failure; Release rolls
+	// it back. The upsert takes the lock itself, which INSERT IGNORE would
+	// only share.
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO auth_throttles (throttleKey, failures, lastFailureAt, expiresAt)
+		VALUES (?, 0, ?, ?)
+		ON DUPLICATE KEY UPDATE throttleKey = throttleKey
+	`, key, now, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to lock throttle state: %w", err)
+	}
+
+	state, err := loadThrottleState(tx, key, true)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &ThrottledAttempt{db: db, tx: tx, policy: policy, key: key, state: state, now: now}, nil
+}
+
+// RetryAfter is how long the key must wait before this attempt may go ahead,
+// zero if it may go ahead now.
+func (a *ThrottledAttempt) RetryAfter() time.Duration {
+	return a.policy.retryAfter(a.state, a.now)
+}
+
+// Record counts the attempt as a failure and unlocks the key. It reports
+// whether this attempt locked the key, so the owner can be told once.
+func (a *ThrottledAttempt) Record() (bool, error) {
+	defer a.Release()
+
+	s := a.policy.next(a.state, a.now)
+
+	var blockedUntil interface{}
+	if !s.BlockedUntil.IsZero() {
+		blockedUntil = s.BlockedUntil
+	}
+
+	_, err := a.tx.Exec(`
+		UPDATE auth_throttles
+		SET failures = ?, lastFailureAt = ?, blockedUntil = ?, expiresAt = ?
+		WHERE throttleKey = ?
+	`, s.Failures, s.LastFailureAt, blockedUntil, a.policy.expiresAt(s), a.key)
+	if err != nil {
+		return false, fmt.Errorf("failed to record attempt: %w", err)
+	}
+
+	if err := a.tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// The failure is counted either way, and a failed clean-up is retried
+	// with the next one
+	deleteExpiredThrottles(a.db, a.now)
+	return a.policy.locks(s), nil
+}
+
+// Reset forgets every attempt of the key and unlocks it, e.g. after the
+// attempt succeeded.
+func (a *ThrottledAttempt) Reset() error {
+	defer a.Release()
+
+	if err := ResetThrottle(a.tx, a.key); err != nil {
+		return err
+	}
+	if err := a.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Release unlocks the key without counting the attempt. It does nothing
+// once the attempt has been ended.
+func (a *ThrottledAttempt) Release() {
+	a.tx.Rollback()
+}
+
+// ThrottleAttempt counts an attempt against the key unless the key has to
+// wait first, in which case it returns how long. Check and count happen
+// under one lock.
+func ThrottleAttempt(db *sql.DB, policy ThrottlePolicy, key string) (time.Duration, error) {
+	attempt, err := BeginThrottledAttempt(db, policy, key)
+	if err != nil {
+		return 0, err
+	}
+	if retryAfter := attempt.RetryAfter(); retryAfter > 0 {
+		attempt.Release()
+		return retryAfter, nil
+	}
+	_, err = attempt.Record()
+	return 0, err
+}
+
+// deleteExpiredThrottles drops the rows of keys whose failures no longer
+// count.
+func deleteExpiredThrottles(db execer, now time.Time) error {
+	if _, err := db.Exec("DELETE FROM auth_throttles WHERE expiresAt < ?", now); err != nil {
+		return fmt.Errorf("failed to clean up throttles: %w", err)
+	}
+	return nil
+}
+
+// ThrottleRetryAfter is how long the key has to wait before its next
+// attempt. It reads without a lock, for keys many clients share, such as an
+// IP address, where waiting on each other would cost more than the few extra
+// attempts that can slip through together.
+func ThrottleRetryAfter(db *sql.DB, policy ThrottlePolicy, key string) (time.Duration, error) {
+	state, err := loadThrottleState(db, key, false)
+	if err != nil {
+		return 0, err
+	}
+	return policy.retryAfter(state, time.Now()), nil
+}
+
+// RecordThrottledFailure counts a failed attempt against a key checked with
+// ThrottleRetryAfter. It reports whether this failure locked the key.
+func RecordThrottledFailure(db *sql.DB, policy ThrottlePolicy, key string) (bool, error) {
+	attempt, err := BeginThrottledAttempt(db, policy, key)
+	if err != nil {
+		return false, err
+	}
+	return attempt.Record()
+}
+
+// ResetThrottle forgets the attempts of the given keys, e.g. after a
+// successful login or an unlock.
+func ResetThrottle(db execer, keys ...string) error {
+	for _, key := range keys {
+		if _, err := db.Exec("DELETE FROM auth_throttles WHERE throttleKey = ?", key); err != nil {
+			return fmt.Errorf("failed to reset throttle: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottlePolicyBackoffAndLockout(t *testing.T) {
+	policy := LoginAccountPolicy
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures int
+		delay    time.Duration
+		locks    bool
+	}{
+		{1, 0, false},
+		{2, 0, false},
+		{3, 0, false},
+		{4, time.Second, false},
+		{5, 2 * time.Second, false},
+		{6, 4 * time.Second, false},
+		{7, 8 * time.Second, false},
+		{8, 16 * time.Second, false},
+		{9, 32 * time.Second, false},
+		{10, 30 * time.Minute, true},
+		{11, 30 * time.Minute, false},
+		{12, 30 * time.Minute, false},
+	}
+
+	var s throttleState
+	now := start
+	for _, tt := range tests {
+		// Each attempt waits out the previous block, as a client honouring
+		// Retry-After would
+		if wait := policy.retryAfter(s, now); wait > 0 {
+			now = now.Add(wait)
+		}
+		if got := policy.retryAfter(s, now); got != 0 {
+			t.Fatalf("attempt %d: still blocked for %v after waiting", tt.failures, got)
+		}
+
+		s = policy.next(s, now)
+		if s.Failures != tt.failures {
+			t.Fatalf("attempt %d: failures = %d", tt.failures, s.Failures)
+		}
+		if got := policy.retryAfter(s, now); got != tt.delay {
+			t.Errorf("attempt %d: retry after = %v, want %v", tt.failures, got, tt.delay)
+		}
+		if got := policy.locks(s); got != tt.locks {
+			t.Errorf("attempt %d: locks = %v, want %v", tt.failures, got, tt.locks)
+		}
+	}
+}
+
+func TestThrottlePolicyRetryAfterCountsDown(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := throttleState{Failures: 5, LastFailureAt: now, BlockedUntil: now.Add(10 * time.Second)}
+
+	tests := []struct {
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{0, 10 * time.Second},
+		{4 * time.Second, 6 * time.Second},
+		{10 * time.Second, 0},
+		{time.Minute, 0},
+	}
+	for _, tt := range tests {
+		if got := LoginAccountPolicy.retryAfter(s, now.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("after %v: retry after = %v, want %v", tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestThrottlePolicyDelayIsCapped(t *testing.T) {
+	policy := ThrottlePolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second, Window: time.Hour}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{40, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		s := policy.next(throttleState{Failures: tt.failures - 1, LastFailureAt: now}, now)
+		if got := policy.retryAfter(s, now); got != tt.want {
+			t.Errorf("failure %d: retry after = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestThrottlePolicyWindow(t *testing.T) {
+	policy := LoginAccountPolicy
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		state throttleState
+		want  int
+	}{
+		{
+			name:  "recent failures are kept",
+			state: throttleState{Failures: 5, LastFailureAt: now.Add(-30 * time.Minute)},
+			want:  6,
+		},
+		{
+			name:  "old failures are forgotten",
+			state: throttleState{Failures: 5, LastFailureAt: now.Add(-2 * time.Hour)},
+			want:  1,
+		},
+		{
+			name: "old failures are kept while locked",
+			state: throttleState{
+				Failures:      10,
+				LastFailureAt: now.Add(-2 * time.Hour),
+				BlockedUntil:  now.Add(time.Minute),
+			},
+			want: 11,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.next(tt.state, now).Failures; got != tt.want {
+				t.Errorf("failures = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottlePolicyWithoutLockout(t *testing.T) {
+	policy := LoginIPPolicy
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var s throttleState
+	for i := 0; i < 50; i++ {
+		s = policy.next(s, now)
+		if policy.locks(s) {
+			t.Fatalf("failure %d locked a policy without lockout", s.Failures)
+		}
+	}
+	if got := policy.retryAfter(s, now); got != policy.MaxDelay {
+		t.Errorf("retry after = %v, want %v", got, policy.MaxDelay)
+	}
+}
+
+func TestThrottleKey(t *testing.T) {
+	if got := UserThrottleKey(LoginAccountPolicy, 42); got != "login:user:42" {
+		t.Errorf("UserThrottleKey = %q", got)
+	}
+	if got := ThrottleKey(LoginIPPolicy, "ip", "10.0.0.1"); got != "login-ip:ip:10.0.0.1" {
+		t.Errorf("ThrottleKey ip = %q", got)
+	}
+
+	upper := ThrottleKey(ForgotPasswordEmailPolicy, "email", " Someone@Example.com ")
+	lower := ThrottleKey(ForgotPasswordEmailPolicy, "email", "someone@example.com")
+	if upper != lower {
+		t.Errorf("email keys differ by case: %q, %q", upper, lower)
+	}
+	if upper == "forgot-password:email:someone@example.com" {
+		t.Error("email is stored in the key unhashed")
+	}
+}
+
+func TestThrottlePolicyExpiry(t *testing.T) {
+	policy := LoginAccountPolicy
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		state throttleState
+		want  time.Time
+	}{
+		{
+			name:  "failures expire with the window",
+			state: throttleState{Failures: 5, LastFailureAt: now, BlockedUntil: now.Add(2 * time.Second)},
+			want:  now.Add(policy.Window),
+		},
+		{
+			name:  "a block outlasting the window keeps the row",
+			state: throttleState{Failures: 10, LastFailureAt: now, BlockedUntil: now.Add(2 * policy.Window)},
+			want:  now.Add(2 * policy.Window),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.expiresAt(tt.state); !got.Equal(tt.want) {
+				t.Errorf("expires at %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Once a row expires, the next failure starts over, so dropping it
+	// changes nothing
+	s := policy.next(throttleState{}, now)
+	for i := 0; i < 20; i++ {
+		s = policy.next(s, now.Add(time.Duration(i)*time.Minute))
+	}
+	after := policy.expiresAt(s).Add(time.Second)
+	if got, want := policy.next(s, after), policy.next(throttleState{}, after); got != want {
+		t.Errorf("failure after expiry = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"online-learning-golang/utils"
+)
+
+// UnlockTokenTTL is how long the link in an unlock email works.
+const UnlockTokenTTL = 24 * time.Hour
+
+var ErrInvalidUnlockToken = errors.New("invalid or expired unlock token")
+
+// IssueAccountUnlock stores a token that lifts the login lockout of the user,
+// to be mailed with utils.SendUnlockEmail.
+func IssueAccountUnlock(db *sql.DB, userID int) (string, error) {
+	token, err := utils.GenerateResetToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate unlock token: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM account_unlock_tokens WHERE userId = ?", userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to clear unlock tokens: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO account_unlock_tokens (userId, token, expiry)
+		VALUES (?, ?, ?)
+	`, userID, token, time.Now().Add(UnlockTokenTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store unlock token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// UnlockAccount lifts the login lockout of the user the token was sent to.
+func UnlockAccount(db *sql.DB, token string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var expiry time.Time
+	err = tx.QueryRow("SELECT userId, expiry FROM account_unlock_tokens WHERE token = ?", token).Scan(&userID, &expiry)
+	if err == sql.ErrNoRows {
+		return ErrInvalidUnlockToken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch unlock token: %w", err)
+	}
+	if time.Now().After(expiry) {
+		return ErrInvalidUnlockToken
+	}
+
+	if err := ResetThrottle(tx, UserThrottleKey(LoginAccountPolicy, userID)); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM account_unlock_tokens WHERE userId = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate unlock token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
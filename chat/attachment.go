@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MaxAttachments      = 10
+	MaxImageSize        = 5 * 1024 * 1024
+	MaxDocumentSize     = 10 * 1024 * 1024
+	AttachmentMimePDF   = "application/pdf"
+	attachmentMaxUnused = 24 * time.Hour
+)
+
+// ErrAttachmentUnavailable is returned when a message refers to an
+// attachment that does not exist, belongs to someone else or was already
+// sent with another message.
+var ErrAttachmentUnavailable = errors.New("attachment not found or already used")
+
+// Attachment is an uploaded file. It is created unattached by the upload
+// endpoint and claimed by the first message that references it.
+type Attachment struct {
+	ID       int    `json:"id"`
+	URL      string `json:"url"`
+	FileName string `json:"fileName"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+func CreateAttachment(db *sql.DB, uploaderID int, attachment *Attachment) error {
+	var width, height sql.NullInt64
+	if attachment.Width > 0 && attachment.Height > 0 {
+		width = sql.NullInt64{Int64: int64(attachment.Width), Valid: true}
+		height = sql.NullInt64{Int64: int64(attachment.Height), Valid: true}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO chat_attachments (uploaderId, url, fileName, mimeType, size, width, height)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, uploaderID, attachment.URL, attachment.FileName, attachment.MimeType, attachment.Size, width, height)
+	if err != nil {
+		return fmt.Errorf("failed to save chat attachment: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get chat attachment ID: %w", err)
+	}
+
+	attachment.ID = int(id)
+	return nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// claimAttachments links the attachments listed in msg.Attachments (only
+// their IDs are read) to the message and replaces them with the stored
+// metadata. Attachments must have been uploaded by the sender recently and
+// not yet be used.
+func claimAttachments(tx *sql.Tx, msg *Message) error {
+	if len(msg.Attachments) == 0 {
+		return nil
+	}
+
+	args := []interface{}{msg.ID, msg.SenderID, time.Now().UTC().Add(-attachmentMaxUnused)}
+	for _, attachment := range msg.Attachments {
+		args = append(args, attachment.ID)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE chat_attachments
+		SET messageId = ?
+		WHERE uploaderId = ? AND messageId IS NULL AND createdAt > ?
+		AND id IN (`+placeholders(len(msg.Attachments))+`)
+	`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to attach files: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to attach files: %w", err)
+	}
+	if int(rowsAffected) != len(msg.Attachments) {
+		return ErrAttachmentUnavailable
+	}
+
+	attachments, err := queryAttachments(tx, []int{msg.ID})
+	if err != nil {
+		return err
+	}
+	msg.Attachments = attachments[msg.ID]
+	return nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryAttachments(db queryer, messageIDs []int) (map[int][]Attachment, error) {
+	attachments := make(map[int][]Attachment)
+	if len(messageIDs) == 0 {
+		return attachments, nil
+	}
+
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(`
+		SELECT id, messageId, url, fileName, mimeType, size, COALESCE(width, 0), COALESCE(height, 0)
+		FROM chat_attachments
+		WHERE messageId IN (`+placeholders(len(messageIDs))+`)
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat attachments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attachment
+		var messageID int
+		if err := rows.Scan(&a.ID, &messageID, &a.URL, &a.FileName, &a.MimeType, &a.Size, &a.Width, &a.Height); err != nil {
+			return nil, fmt.Errorf("failed to scan chat attachment: %w", err)
+		}
+		attachments[messageID] = append(attachments[messageID], a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chat attachments: %w", err)
+	}
+
+	return attachments, nil
+}
+
+// loadAttachments fills in the attachments of messages that have not been
+// deleted.
+func loadAttachments(db *sql.DB, messages []Message) error {
+	ids := []int{}
+	for _, msg := range messages {
+		if !msg.Deleted {
+			ids = append(ids, msg.ID)
+		}
+	}
+
+	attachments, err := queryAttachments(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+	return nil
+}
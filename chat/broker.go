@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// BrokerMessage is a frame on its way to clients, possibly connected to other
+// server instances, or news about presence. Exactly one of Room, UserIDs,
+// Eviction or Presence is set.
+type BrokerMessage struct {
+	Room     string          `json:"room,omitempty"`
+	UserIDs  []int           `json:"userIds,omitempty"`
+	Eviction *Eviction       `json:"eviction,omitempty"`
+	Presence *PresenceUpdate `json:"presence,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// Broker fans frames out to every Manager subscribed to it, including the
+// one that published them. Managers only deliver to their own clients.
+type Broker interface {
+	Publish(msg BrokerMessage) error
+	Subscribe(handler func(BrokerMessage)) error
+	Close() error
+}
+
+// NewBrokerFromEnv picks the broker from CHAT_BROKER: "redis" uses REDIS_URL,
+// anything else keeps everything in process.
+func NewBrokerFromEnv() (Broker, error) {
+	switch os.Getenv("CHAT_BROKER") {
+	case "", "memory":
+		return NewMemoryBroker(), nil
+	case "redis":
+		return NewRedisBroker(os.Getenv("REDIS_URL"), os.Getenv("CHAT_REDIS_CHANNEL"))
+	default:
+		return nil, fmt.Errorf("unknown CHAT_BROKER: %s", os.Getenv("CHAT_BROKER"))
+	}
+}
+
+// MemoryBroker delivers to subscribers in the same process. It is enough for
+// a single server instance.
+//
+// Publish calls the handlers synchronously, and a Manager's handler blocks
+// until its run loop takes the message. The run loop must therefore never
+// publish directly; it queues messages with queuePublish instead.
+type MemoryBroker struct {
+	mutex    sync.RWMutex
+	handlers []func(BrokerMessage)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(msg BrokerMessage) error {
+	// Handlers run without the lock, so a handler that publishes or
+	// subscribes cannot deadlock against it
+	b.mutex.RLock()
+	handlers := b.handlers
+	b.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler func(BrokerMessage)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.handlers = nil
+	return nil
+}
@@ -1,55 +1,104 @@
 package chat
 
 import (
-	"encoding/json"
 	"log"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func (client *Client) WritePump() {
+// WritePump is the only goroutine writing to the connection. It sends queued
+// frames and pings, and closes the connection with the reason recorded by
+// the manager once the client's send channel is closed.
+func (client *Client) WritePump(manager *Manager) {
+	config := manager.Config
+	ticker := time.NewTicker(config.PingPeriod)
 	defer func() {
+		ticker.Stop()
 		client.Conn.Close()
 	}()
 
 	for {
-		message, ok := <-client.Send
-		if !ok {
-			client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
-		}
+		select {
+		case message, ok := <-client.Send:
+			client.Conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if !ok {
+				client.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(client.closeCode, client.closeReason))
+				return
+			}
 
-		err := client.Conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			return
+			if err := client.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// ReadPump reads frames until the connection fails, the client closes it or
+// no frame (pongs included) arrives within PongWait.
 func (client *Client) ReadPump(manager *Manager) {
+	config := manager.Config
 	defer func() {
 		manager.Unregister <- client
 		client.Conn.Close()
 	}()
 
+	client.Conn.SetReadLimit(config.MaxMessageSize)
+	client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	client.Conn.SetPongHandler(func(string) error {
+		return client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	})
+
 	for {
 		_, message, err := client.Conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
+		client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
 
-		msg := Message{
-			Type:      "message",
-			Content:   string(message),
-			SenderID:  client.UserID,
-			Timestamp: time.Now().Format(time.RFC3339),
+		env, perr := DecodeEnvelope(message)
+		if perr == nil {
+			perr = client.handleFrame(manager, env)
+		}
+		if perr != nil {
+			manager.SendTo(client, EncodeFrame(FrameError, env.Room, env.ClientMsgID, ErrorPayload{
+				Code:    perr.Code,
+				Message: perr.Message,
+			}))
 		}
+	}
+}
 
-		jsonMessage, _ := json.Marshal(msg)
-		manager.Broadcast <- jsonMessage
+func (client *Client) handleFrame(manager *Manager, env Envelope) *ProtocolError {
+	switch env.Type {
+	case FrameJoin:
+		return client.handleJoin(manager, env)
+	case FrameLeave:
+		return client.handleLeave(manager, env)
+	case FrameMessage:
+		return client.handleMessage(manager, env)
+	case FrameTyping:
+		return client.handleTyping(manager, env)
+	case FrameRead:
+		return client.handleRead(manager, env)
+	case FrameEdit:
+		return client.handleEdit(manager, env)
+	case FrameDelete:
+		return client.handleDelete(manager, env)
+	case FrameReact:
+		return client.handleReaction(manager, env, true)
+	case FrameUnreact:
+		return client.handleReaction(manager, env, false)
 	}
+
+	return frameErrorf(ErrUnknownType, "unknown frame type: %s", env.Type)
 }
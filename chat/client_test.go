@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testConfig keeps timeouts short so the tests run quickly.
+func testConfig() Config {
+	return Config{
+		WriteWait:      time.Second,
+		PongWait:       300 * time.Millisecond,
+		PingPeriod:     100 * time.Millisecond,
+		MaxMessageSize: 1024,
+		SendBufferSize: 16,
+
+		PresenceInterval: time.Minute,
+	}
+}
+
+// startTestServer runs a manager behind an httptest server that upgrades
+// every request the way HandleWebSocket does, without authentication.
+func startTestServer(t *testing.T, config Config) (*Manager, *httptest.Server) {
+	t.Helper()
+
+	manager := NewManager(nil, NewMemoryBroker())
+	manager.Config = config
+	if err := manager.Subscribe(); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	go manager.Run()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := &Client{
+			ID:     conn.RemoteAddr().String(),
+			UserID: 1,
+			Conn:   conn,
+			Send:   make(chan []byte, manager.Config.SendBufferSize),
+			Rooms:  make(map[string]bool),
+		}
+		manager.Register <- client
+
+		go client.WritePump(manager)
+		go client.ReadPump(manager)
+	}))
+	t.Cleanup(server.Close)
+
+	return manager, server
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func clientCount(manager *Manager) int {
+	manager.Mutex.Lock()
+	defer manager.Mutex.Unlock()
+	return len(manager.Clients)
+}
+
+// waitFor polls cond until it holds or the timeout runs out.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readUntilError reads frames until the connection fails and returns the
+// error, failing the test if that takes longer than timeout.
+func readUntilError(t *testing.T, conn *websocket.Conn, timeout time.Duration) error {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
+func TestPongsKeepConnectionOpen(t *testing.T) {
+	config := testConfig()
+	manager, server := startTestServer(t, config)
+	conn := dial(t, server)
+	waitFor(t, time.Second, "client to register", func() bool { return clientCount(manager) == 1 })
+
+	// Reading lets the default ping handler answer with pongs
+	done := make(chan error, 1)
+	go func() { done <- readUntilError(t, conn, 5*config.PongWait) }()
+
+	time.Sleep(3 * config.PongWait)
+	if clientCount(manager) != 1 {
+		t.Fatal("client answering pings was disconnected")
+	}
+	conn.Close()
+	<-done
+}
+
+func TestMissingPongsCloseConnection(t *testing.T) {
+	config := testConfig()
+	manager, server := startTestServer(t, config)
+	conn := dial(t, server)
+	waitFor(t, time.Second, "client to register", func() bool { return clientCount(manager) == 1 })
+
+	// Swallow pings without answering, like a client that has gone away
+	conn.SetPingHandler(func(string) error { return nil })
+
+	start := time.Now()
+	if err := readUntilError(t, conn, 10*config.PongWait); err == nil {
+		t.Fatal("connection stayed open")
+	}
+	if elapsed := time.Since(start); elapsed >= 10*config.PongWait {
+		t.Fatalf("connection was not closed within the pong wait, took %v", elapsed)
+	}
+	waitFor(t, time.Second, "client to be removed", func() bool { return clientCount(manager) == 0 })
+}
+
+func TestOversizedFrameClosesConnection(t *testing.T) {
+	config := testConfig()
+	manager, server := startTestServer(t, config)
+	conn := dial(t, server)
+	waitFor(t, time.Second, "client to register", func() bool { return clientCount(manager) == 1 })
+
+	frame := bytes.Repeat([]byte("a"), int(config.MaxMessageSize)+1)
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	err := readUntilError(t, conn, time.Second)
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected close %d, got %v", websocket.CloseMessageTooBig, err)
+	}
+	waitFor(t, time.Second, "client to be removed", func() bool { return clientCount(manager) == 0 })
+}
+
+func TestSlowConsumerIsEvicted(t *testing.T) {
+	config := testConfig()
+	config.PongWait = time.Minute
+	config.PingPeriod = 30 * time.Second
+	config.WriteWait = 10 * time.Second
+	config.SendBufferSize = 1
+	manager, server := startTestServer(t, config)
+	conn := dial(t, server)
+	waitFor(t, time.Second, "client to register", func() bool { return clientCount(manager) == 1 })
+
+	// Without reading, the socket buffers fill up, WritePump blocks and the
+	// send buffer overflows
+	frame := bytes.Repeat([]byte("a"), 256*1024)
+	for i := 0; clientCount(manager) == 1; i++ {
+		if i == 1000 {
+			t.Fatal("client that does not read was never evicted")
+		}
+		manager.Broadcast <- RoomMessage{Room: LobbyRoom, Data: frame}
+	}
+
+	err := readUntilError(t, conn, 10*time.Second)
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("expected close %d, got %v", websocket.CloseTryAgainLater, err)
+	}
+}
+
+func TestRemoveClientIsIdempotent(t *testing.T) {
+	manager := NewManager(nil, NewMemoryBroker())
+	client := &Client{UserID: 1, Send: make(chan []byte, 1), Rooms: make(map[string]bool)}
+
+	manager.Mutex.Lock()
+	manager.Clients[client] = true
+	manager.Users[client.UserID] = map[*Client]bool{client: true}
+	manager.joinRoom(client, LobbyRoom)
+
+	// A full buffer gets the client evicted, and its ReadPump then
+	// unregisters it a second time
+	client.Send <- []byte("queued")
+	manager.deliver(map[*Client]bool{client: true}, []byte("overflow"))
+	manager.removeClient(client, websocket.CloseNormalClosure, "")
+	manager.removeClient(client, websocket.CloseNormalClosure, "")
+	manager.Mutex.Unlock()
+
+	if client.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", client.closeCode, websocket.CloseTryAgainLater)
+	}
+	if len(manager.Clients) != 0 || len(manager.Users) != 0 || len(manager.Rooms) != 0 {
+		t.Errorf("client left behind: %d clients, %d users, %d rooms", len(manager.Clients), len(manager.Users), len(manager.Rooms))
+	}
+
+	if data, ok := <-client.Send; !ok || string(data) != "queued" {
+		t.Fatalf("expected the queued frame, got %q, %v", data, ok)
+	}
+	if _, ok := <-client.Send; ok {
+		t.Fatal("send channel was not closed")
+	}
+
+	// Frames sent after removal are dropped instead of panicking on the
+	// closed channel
+	manager.SendTo(client, []byte("late"))
+}
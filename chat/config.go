@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config controls the lifetime of WebSocket connections.
+type Config struct {
+	// WriteWait is how long a single write may take before the connection
+	// is considered dead.
+	WriteWait time.Duration
+	// PongWait is how long to wait for any frame, pongs included, before
+	// giving up on the client. PingPeriod must be shorter.
+	PongWait   time.Duration
+	PingPeriod time.Duration
+	// MaxMessageSize is the largest inbound frame accepted, in bytes.
+	MaxMessageSize int64
+	// SendBufferSize is how many outbound frames may queue up before the
+	// client is dropped as a slow consumer.
+	SendBufferSize int
+	// PresenceInterval is how often each server instance publishes who is
+	// connected to it. Instances silent for three intervals are considered
+	// gone.
+	PresenceInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		WriteWait:      10 * time.Second,
+		PongWait:       60 * time.Second,
+		PingPeriod:     54 * time.Second,
+		MaxMessageSize: 16 * 1024,
+		SendBufferSize: 256,
+
+		PresenceInterval: 30 * time.Second,
+	}
+}
+
+// ConfigFromEnv starts from DefaultConfig and applies CHAT_WRITE_WAIT,
+// CHAT_PONG_WAIT, CHAT_PING_PERIOD and CHAT_PRESENCE_INTERVAL (seconds),
+// CHAT_MAX_MESSAGE_SIZE (bytes) and CHAT_SEND_BUFFER_SIZE (frames) when set.
+func ConfigFromEnv() Config {
+	config := DefaultConfig()
+
+	if seconds := envInt("CHAT_WRITE_WAIT"); seconds > 0 {
+		config.WriteWait = time.Duration(seconds) * time.Second
+	}
+	if seconds := envInt("CHAT_PONG_WAIT"); seconds > 0 {
+		config.PongWait = time.Duration(seconds) * time.Second
+		config.PingPeriod = config.PongWait * 9 / 10
+	}
+	if seconds := envInt("CHAT_PING_PERIOD"); seconds > 0 && time.Duration(seconds)*time.Second < config.PongWait {
+		config.PingPeriod = time.Duration(seconds) * time.Second
+	}
+	if size := envInt("CHAT_MAX_MESSAGE_SIZE"); size > 0 {
+		config.MaxMessageSize = int64(size)
+	}
+	if size := envInt("CHAT_SEND_BUFFER_SIZE"); size > 0 {
+		config.SendBufferSize = size
+	}
+	if seconds := envInt("CHAT_PRESENCE_INTERVAL"); seconds > 0 {
+		config.PresenceInterval = time.Duration(seconds) * time.Second
+	}
+
+	return config
+}
+
+func envInt(key string) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return 0
+	}
+	return value
+}
@@ -0,0 +1,191 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Direct conversations are stored like any other room, under the name
+// "dm:<lower user ID>:<higher user ID>", and are delivered to users rather
+// than to joined clients.
+const RoomDirect = "dm"
+
+type UserSummary struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	FullName string `json:"fullName"`
+	Avatar   string `json:"avatar"`
+}
+
+type Conversation struct {
+	Room           string      `json:"room"`
+	User           UserSummary `json:"user"`
+	LastMessage    Message     `json:"lastMessage"`
+	UnreadCount    int         `json:"unreadCount"`
+	LastReadByUser int         `json:"lastReadByUser"`
+}
+
+func DirectRoom(userID, otherUserID int) string {
+	if userID > otherUserID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return fmt.Sprintf("%s:%d:%d", RoomDirect, userID, otherUserID)
+}
+
+func IsDirectRoom(room string) bool {
+	return strings.HasPrefix(room, RoomDirect+":")
+}
+
+func ParseDirectRoom(room string) (int, int, error) {
+	parts := strings.Split(room, ":")
+	if len(parts) != 3 || parts[0] != RoomDirect {
+		return 0, 0, fmt.Errorf("invalid room: %s", room)
+	}
+
+	userOneID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid room: %s", room)
+	}
+	userTwoID, err := strconv.Atoi(parts[2])
+	if err != nil || userOneID < 1 || userOneID >= userTwoID {
+		return 0, 0, fmt.Errorf("invalid room: %s", room)
+	}
+
+	return userOneID, userTwoID, nil
+}
+
+func UserExists(db *sql.DB, userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM users WHERE id = ? AND deletedAt IS NULL", userID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check user: %w", err)
+	}
+	return exists, nil
+}
+
+func GetUserSummaries(db *sql.DB, userIDs []int) ([]UserSummary, error) {
+	users := []UserSummary{}
+	if len(userIDs) == 0 {
+		return users, nil
+	}
+
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(`
+		SELECT id, username, fullName, avatar
+		FROM users
+		WHERE id IN (`+placeholders(len(userIDs))+`) AND deletedAt IS NULL
+		ORDER BY fullName
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user UserSummary
+		if err := rows.Scan(&user.ID, &user.Username, &user.FullName, &user.Avatar); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users: %w", err)
+	}
+
+	return users, nil
+}
+
+// SaveDirectMessage stores a message in a direct room and moves the
+// conversation to the top of both participants' lists.
+func SaveDirectMessage(db *sql.DB, msg *Message) error {
+	userOneID, userTwoID, err := ParseDirectRoom(msg.Room)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertMessage(tx, msg); err != nil {
+		return err
+	}
+	if err := claimAttachments(tx, msg); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO chat_conversations (room, userOneId, userTwoId, lastMessageId)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE lastMessageId = VALUES(lastMessageId)
+	`, msg.Room, userOneID, userTwoID, msg.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func GetConversations(db *sql.DB, userID int) ([]Conversation, error) {
+	rows, err := db.Query(`
+		SELECT cv.room, u.id, u.username, u.fullName, u.avatar,
+			m.id, IF(m.deletedAt IS NULL, m.content, ''), m.senderId, m.createdAt, m.deletedAt IS NOT NULL,
+			(
+				SELECT COUNT(*)
+				FROM chat_messages um
+				WHERE um.room = cv.room
+				AND um.senderId <> ?
+				AND um.deletedAt IS NULL
+				AND um.id > COALESCE(rs.lastReadMessageId, 0)
+			) AS unreadCount,
+			COALESCE(ors.lastReadMessageId, 0)
+		FROM chat_conversations cv
+		JOIN users u ON u.id = IF(cv.userOneId = ?, cv.userTwoId, cv.userOneId)
+		JOIN chat_messages m ON m.id = cv.lastMessageId
+		LEFT JOIN chat_read_states rs ON rs.room = cv.room AND rs.userId = ?
+		LEFT JOIN chat_read_states ors ON ors.room = cv.room AND ors.userId = u.id
+		WHERE cv.userOneId = ? OR cv.userTwoId = ?
+		ORDER BY cv.lastMessageId DESC
+	`, userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var cv Conversation
+		var createdAt time.Time
+		err := rows.Scan(
+			&cv.Room, &cv.User.ID, &cv.User.Username, &cv.User.FullName, &cv.User.Avatar,
+			&cv.LastMessage.ID, &cv.LastMessage.Content, &cv.LastMessage.SenderID, &createdAt, &cv.LastMessage.Deleted,
+			&cv.UnreadCount, &cv.LastReadByUser,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+		cv.LastMessage.Type = FrameMessage
+		cv.LastMessage.Room = cv.Room
+		cv.LastMessage.Timestamp = formatTimestamp(createdAt)
+		conversations = append(conversations, cv)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read conversations: %w", err)
+	}
+
+	return conversations, nil
+}
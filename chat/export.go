@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxTranscriptMessages caps the size of one export. Longer histories have to
+// be exported in several date ranges.
+const MaxTranscriptMessages = 20000
+
+var ErrTranscriptTooLarge = fmt.Errorf("transcript has more than %d messages, narrow the date range", MaxTranscriptMessages)
+
+type TranscriptMessage struct {
+	Message
+	SenderUsername string `json:"senderUsername"`
+	SenderName     string `json:"senderName"`
+}
+
+type Transcript struct {
+	Room        string              `json:"room"`
+	From        string              `json:"from,omitempty"`
+	To          string              `json:"to,omitempty"`
+	GeneratedAt string              `json:"generatedAt"`
+	Messages    []TranscriptMessage `json:"messages"`
+}
+
+// GetTranscript returns every message of a room posted in [from, to), oldest
+// first, with sender names. Zero times leave that end of the range open.
+func GetTranscript(db *sql.DB, room string, from, to time.Time) (*Transcript, error) {
+	query := `SELECT ` + messageColumns + ` FROM chat_messages m WHERE m.room = ?`
+	args := []interface{}{room}
+
+	transcript := &Transcript{Room: room, GeneratedAt: formatTimestamp(time.Now())}
+	if !from.IsZero() {
+		query += " AND m.createdAt >= ?"
+		args = append(args, from.UTC())
+		transcript.From = formatTimestamp(from)
+	}
+	if !to.IsZero() {
+		query += " AND m.createdAt < ?"
+		args = append(args, to.UTC())
+		transcript.To = formatTimestamp(to)
+	}
+	query += " ORDER BY m.id ASC LIMIT ?"
+	args = append(args, MaxTranscriptMessages+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat messages: %w", err)
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > MaxTranscriptMessages {
+		return nil, ErrTranscriptTooLarge
+	}
+	if err := loadAttachments(db, messages); err != nil {
+		return nil, err
+	}
+
+	senders := make(map[int]UserSummary)
+	senderIDs := []int{}
+	for _, msg := range messages {
+		if _, ok := senders[msg.SenderID]; !ok {
+			senders[msg.SenderID] = UserSummary{}
+			senderIDs = append(senderIDs, msg.SenderID)
+		}
+	}
+	users, err := GetUserSummaries(db, senderIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		senders[user.ID] = user
+	}
+
+	transcript.Messages = make([]TranscriptMessage, len(messages))
+	for i, msg := range messages {
+		sender := senders[msg.SenderID]
+		transcript.Messages[i] = TranscriptMessage{
+			Message:        msg,
+			SenderUsername: sender.Username,
+			SenderName:     sender.FullName,
+		}
+	}
+
+	return transcript, nil
+}
+
+// csvCell keeps spreadsheet programs from evaluating user content as a
+// formula.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func WriteTranscriptCSV(w io.Writer, transcript *Transcript) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"id", "timestamp", "senderId", "senderUsername", "senderName", "parentId", "content", "editedAt", "deleted", "attachments"})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range transcript.Messages {
+		urls := make([]string, len(msg.Attachments))
+		for i, attachment := range msg.Attachments {
+			urls[i] = attachment.URL
+		}
+
+		parentID := ""
+		if msg.ParentID > 0 {
+			parentID = strconv.Itoa(msg.ParentID)
+		}
+
+		err := writer.Write([]string{
+			strconv.Itoa(msg.ID),
+			msg.Timestamp,
+			strconv.Itoa(msg.SenderID),
+			csvCell(msg.SenderUsername),
+			csvCell(msg.SenderName),
+			parentID,
+			csvCell(msg.Content),
+			msg.EditedAt,
+			strconv.FormatBool(msg.Deleted),
+			strings.Join(urls, " "),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+var transcriptTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat transcript - {{.Room}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0.2em; }
+.meta { color: #666; margin-bottom: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 6px 8px; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+td.time { white-space: nowrap; color: #555; }
+td.content { white-space: pre-wrap; }
+.reply { color: #888; font-size: 0.9em; }
+.deleted { color: #999; font-style: italic; }
+@media print { th { background: none; } }
+</style>
+</head>
+<body>
+<h1>Chat transcript: {{.Room}}</h1>
+<div class="meta">
+{{if .From}}From {{.From}} {{end}}{{if .To}}to {{.To}} {{end}}&middot; {{len .Messages}} messages &middot; generated {{.GeneratedAt}}
+</div>
+<table>
+<thead><tr><th>#</th><th>Time</th><th>Sender</th><th>Message</th></tr></thead>
+<tbody>
+{{range .Messages}}<tr>
+<td>{{.ID}}</td>
+<td class="time">{{.Timestamp}}</td>
+<td>{{if .SenderName}}{{.SenderName}}{{else}}User {{.SenderID}}{{end}}{{if .SenderUsername}}<br><small>@{{.SenderUsername}}</small>{{end}}</td>
+<td class="content">{{if .ParentID}}<div class="reply">Reply to #{{.ParentID}}</div>{{end}}{{if .Deleted}}<span class="deleted">Message deleted</span>{{else}}{{.Content}}{{range .Attachments}}
+<a href="{{.URL}}">{{.FileName}}</a>{{end}}{{if .EditedAt}} <small>(edited)</small>{{end}}{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+func WriteTranscriptHTML(w io.Writer, transcript *Transcript) error {
+	return transcriptTemplate.Execute(w, transcript)
+}
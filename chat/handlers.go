@@ -0,0 +1,391 @@
+package chat
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+func (client *Client) handleJoin(manager *Manager, env Envelope) *ProtocolError {
+	if _, _, err := ParseRoom(env.Room); err != nil {
+		return frameErrorf(ErrInvalidRoom, "%s", err.Error())
+	}
+	if manager.InRoom(client, env.Room) {
+		return nil
+	}
+
+	allowed, err := CanJoin(manager.DB, client.UserID, client.Role, env.Room)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to check room access")
+	}
+	if !allowed {
+		return frameErrorf(ErrForbidden, "access to room denied")
+	}
+
+	if perr := client.checkSanction(manager, env.Room, SanctionBan); perr != nil {
+		return perr
+	}
+
+	manager.Join <- Subscription{Client: client, Room: env.Room}
+	manager.SendTo(client, EncodeFrame(FrameAck, env.Room, env.ClientMsgID, nil))
+	return nil
+}
+
+func (client *Client) handleLeave(manager *Manager, env Envelope) *ProtocolError {
+	if env.Room == LobbyRoom {
+		return frameErrorf(ErrForbidden, "cannot leave the lobby")
+	}
+
+	manager.Leave <- Subscription{Client: client, Room: env.Room}
+	manager.SendTo(client, EncodeFrame(FrameAck, env.Room, env.ClientMsgID, nil))
+	return nil
+}
+
+func (client *Client) handleMessage(manager *Manager, env Envelope) *ProtocolError {
+	var payload MessagePayload
+	if perr := decodePayload(env, &payload); perr != nil {
+		return perr
+	}
+	if perr := payload.validate(); perr != nil {
+		return perr
+	}
+
+	room := env.Room
+	if payload.To != 0 {
+		room = DirectRoom(client.UserID, payload.To)
+	} else if room == "" {
+		room = LobbyRoom
+	}
+
+	if perr := client.checkAccess(manager, room); perr != nil {
+		return perr
+	}
+	if perr := client.checkSanction(manager, room, SanctionMute); perr != nil {
+		return perr
+	}
+
+	msg := Message{
+		Type:     FrameMessage,
+		Room:     room,
+		Content:  payload.Content,
+		SenderID: client.UserID,
+	}
+	if payload.ParentID != 0 {
+		rootID, err := ResolveParent(manager.DB, room, payload.ParentID)
+		if err == ErrParentUnavailable {
+			return frameErrorf(ErrNotFound, "%s", err.Error())
+		}
+		if err != nil {
+			log.Printf("error: %v", err)
+			return frameErrorf(ErrInternal, "failed to load parent message")
+		}
+		msg.ParentID = rootID
+	}
+	for _, id := range payload.Attachments {
+		msg.Attachments = append(msg.Attachments, Attachment{ID: id})
+	}
+
+	var err error
+	if IsDirectRoom(room) {
+		err = SaveDirectMessage(manager.DB, &msg)
+	} else {
+		err = SaveMessage(manager.DB, &msg)
+	}
+	if err == ErrAttachmentUnavailable {
+		return frameErrorf(ErrInvalidInput, "%s", err.Error())
+	}
+	if err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to save message")
+	}
+
+	// A failure here should not lose a message that is already saved
+	mentioned, err := ResolveMentions(manager.DB, room, client.UserID, ParseMentions(msg.Content))
+	if err == nil {
+		err = SaveMentions(manager.DB, msg.ID, mentioned)
+	}
+	if err != nil {
+		log.Printf("error: %v", err)
+		mentioned = nil
+	}
+	for _, user := range mentioned {
+		msg.Mentions = append(msg.Mentions, user.ID)
+	}
+
+	manager.SendTo(client, EncodeFrame(FrameAck, room, env.ClientMsgID, AckPayload{
+		MessageID: msg.ID,
+		Timestamp: msg.Timestamp,
+	}))
+	manager.Publish(room, EncodeFrame(FrameMessage, room, env.ClientMsgID, msg))
+	go manager.NotifyMentions(msg, mentioned)
+	return nil
+}
+
+// handleTyping relays typing state to the room without storing it. Clients
+// are expected to send typing=false when done, or let it expire.
+func (client *Client) handleTyping(manager *Manager, env Envelope) *ProtocolError {
+	var payload TypingPayload
+	if perr := decodePayload(env, &payload); perr != nil {
+		return perr
+	}
+
+	if perr := client.checkAccess(manager, env.Room); perr != nil {
+		return perr
+	}
+	if perr := client.checkSanction(manager, env.Room, SanctionMute); perr != nil {
+		return perr
+	}
+
+	manager.Publish(env.Room, EncodeFrame(FrameTyping, env.Room, "", TypingPayload{
+		UserID: client.UserID,
+		Typing: payload.Typing,
+	}))
+	return nil
+}
+
+// handleRead moves the client's read position in a room forward and tells
+// the other members, so senders can see their message was seen.
+func (client *Client) handleRead(manager *Manager, env Envelope) *ProtocolError {
+	var payload ReadPayload
+	if perr := decodePayload(env, &payload); perr != nil {
+		return perr
+	}
+	if perr := payload.validate(); perr != nil {
+		return perr
+	}
+
+	if perr := client.checkAccess(manager, env.Room); perr != nil {
+		return perr
+	}
+
+	exists, err := MessageInRoom(manager.DB, payload.MessageID, env.Room)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to check message")
+	}
+	if !exists {
+		return frameErrorf(ErrNotFound, "message not found")
+	}
+
+	if err := MarkRead(manager.DB, client.UserID, env.Room, payload.MessageID); err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to mark messages as read")
+	}
+
+	manager.SendTo(client, EncodeFrame(FrameAck, env.Room, env.ClientMsgID, AckPayload{MessageID: payload.MessageID}))
+	manager.Publish(env.Room, EncodeFrame(FrameRead, env.Room, "", ReadPayload{
+		UserID:    client.UserID,
+		MessageID: payload.MessageID,
+	}))
+	return nil
+}
+
+// handleEdit lets senders change their own message within EditWindow.
+func (client *Client) handleEdit(manager *Manager, env Envelope) *ProtocolError {
+	var payload EditPayload
+	if perr := decodePayload(env, &payload); perr != nil {
+		return perr
+	}
+	if perr := payload.validate(); perr != nil {
+		return perr
+	}
+
+	msg, perr := client.loadMessage(manager, payload.MessageID)
+	if perr != nil {
+		return perr
+	}
+	if msg.SenderID != client.UserID {
+		return frameErrorf(ErrForbidden, "only the sender can edit a message")
+	}
+	if time.Since(msg.CreatedAt) > EditWindow {
+		return frameErrorf(ErrForbidden, "messages can only be edited within %s", EditWindow)
+	}
+	if perr := client.checkSanction(manager, msg.Room, SanctionMute); perr != nil {
+		return perr
+	}
+
+	if err := EditMessage(manager.DB, &msg.Message, client.UserID, payload.Content); err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to edit message")
+	}
+
+	manager.SendTo(client, EncodeFrame(FrameAck, msg.Room, env.ClientMsgID, AckPayload{
+		MessageID: msg.ID,
+		Timestamp: msg.EditedAt,
+	}))
+	manager.Publish(msg.Room, EncodeFrame(FrameEdit, msg.Room, env.ClientMsgID, msg.Message))
+	return nil
+}
+
+// handleDelete lets senders remove their own message within EditWindow,
+// unless they are muted or banned in the room, and admins remove any message.
+func (client *Client) handleDelete(manager *Manager, env Envelope) *ProtocolError {
+	var payload DeletePayload
+	if perr := decodePayload(env, &payload); perr != nil {
+		return perr
+	}
+	if perr := payload.validate(); perr != nil {
+		return perr
+	}
+
+	msg, perr := client.loadMessage(manager, payload.MessageID)
+	if perr != nil {
+		return perr
+	}
+	if client.Role != "admin" {
+		if msg.SenderID != client.UserID {
+			return frameErrorf(ErrForbidden, "only the sender or an admin can delete a message")
+		}
+		if time.Since(msg.CreatedAt) > EditWindow {
+			return frameErrorf(ErrForbidden, "messages can only be deleted within %s", EditWindow)
+		}
+		if perr := client.checkSanction(manager, msg.Room, SanctionMute); perr != nil {
+			return perr
+		}
+	}
+
+	if err := DeleteMessage(manager.DB, &msg.Message, client.UserID); err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to delete message")
+	}
+
+	manager.SendTo(client, EncodeFrame(FrameAck, msg.Room, env.ClientMsgID, AckPayload{MessageID: msg.ID}))
+	manager.Publish(msg.Room, EncodeFrame(FrameDelete, msg.Room, env.ClientMsgID, DeletePayload{
+		MessageID: msg.ID,
+		UserID:    client.UserID,
+	}))
+	return nil
+}
+
+// handleReaction adds or removes one of the client's reactions to a message
+// and broadcasts the message's new reaction counts.
+func (client *Client) handleReaction(manager *Manager, env Envelope, add bool) *ProtocolError {
+	var payload ReactionPayload
+	if perr := decodePayload(env, &payload); perr != nil {
+		return perr
+	}
+	if perr := payload.validate(); perr != nil {
+		return perr
+	}
+
+	msg, perr := client.loadMessage(manager, payload.MessageID)
+	if perr != nil {
+		return perr
+	}
+	if perr := client.checkSanction(manager, msg.Room, SanctionMute); perr != nil {
+		return perr
+	}
+
+	var changed bool
+	var err error
+	if add {
+		changed, err = AddReaction(manager.DB, msg.ID, client.UserID, payload.Emoji)
+	} else {
+		changed, err = RemoveReaction(manager.DB, msg.ID, client.UserID, payload.Emoji)
+	}
+	if err == ErrTooManyReactions {
+		return frameErrorf(ErrInvalidInput, "%s", err.Error())
+	}
+	if err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to update reaction")
+	}
+
+	manager.SendTo(client, EncodeFrame(FrameAck, msg.Room, env.ClientMsgID, AckPayload{MessageID: msg.ID}))
+	if !changed {
+		return nil
+	}
+
+	reactions, err := GetReactions(manager.DB, msg.ID)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return nil
+	}
+	manager.Publish(msg.Room, EncodeFrame(env.Type, msg.Room, env.ClientMsgID, ReactionPayload{
+		MessageID: msg.ID,
+		Emoji:     payload.Emoji,
+		UserID:    client.UserID,
+		Reactions: reactions,
+	}))
+	return nil
+}
+
+// loadMessage fetches a message that the client can see and that has not
+// been deleted. Admins can see every message.
+func (client *Client) loadMessage(manager *Manager, messageID int) (*storedMessage, *ProtocolError) {
+	msg, err := getStoredMessage(manager.DB, messageID)
+	if err == sql.ErrNoRows {
+		return nil, frameErrorf(ErrNotFound, "message not found")
+	}
+	if err != nil {
+		log.Printf("error: %v", err)
+		return nil, frameErrorf(ErrInternal, "failed to load message")
+	}
+	if msg.Deleted {
+		return nil, frameErrorf(ErrNotFound, "message not found")
+	}
+
+	if client.Role != "admin" {
+		if perr := client.checkAccess(manager, msg.Room); perr != nil {
+			return nil, perr
+		}
+	}
+	return msg, nil
+}
+
+// checkAccess makes sure the client may act in a room: it must be one of the
+// two participants of a direct room, or have joined any other room.
+func (client *Client) checkAccess(manager *Manager, room string) *ProtocolError {
+	if !IsDirectRoom(room) {
+		if !manager.InRoom(client, room) {
+			return frameErrorf(ErrForbidden, "join the room first")
+		}
+		return nil
+	}
+
+	userOneID, userTwoID, err := ParseDirectRoom(room)
+	if err != nil {
+		return frameErrorf(ErrInvalidRoom, "%s", err.Error())
+	}
+
+	recipientID := userOneID
+	if recipientID == client.UserID {
+		recipientID = userTwoID
+	} else if userTwoID != client.UserID {
+		return frameErrorf(ErrForbidden, "access to room denied")
+	}
+
+	exists, err := UserExists(manager.DB, recipientID)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to check recipient")
+	}
+	if !exists {
+		return frameErrorf(ErrNotFound, "recipient not found")
+	}
+
+	return nil
+}
+
+// checkSanction rejects the action if the client is banned from the room,
+// or also muted when minimum is SanctionMute.
+func (client *Client) checkSanction(manager *Manager, room, minimum string) *ProtocolError {
+	if IsDirectRoom(room) {
+		return nil
+	}
+
+	sanction, err := ActiveSanction(manager.DB, client.UserID, room)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return frameErrorf(ErrInternal, "failed to check sanctions")
+	}
+
+	switch {
+	case sanction == SanctionBan:
+		return frameErrorf(ErrForbidden, "you are banned from this room")
+	case sanction == SanctionMute && minimum == SanctionMute:
+		return frameErrorf(ErrForbidden, "you are muted in this room")
+	}
+	return nil
+}
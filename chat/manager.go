@@ -1,7 +1,10 @@
 package chat
 
 import (
+	"database/sql"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -9,62 +12,357 @@ import (
 type Client struct {
 	ID     string
 	UserID int
+	Role   string
 	Conn   *websocket.Conn
 	Send   chan []byte
+	Rooms  map[string]bool
+
+	// Set by the manager before Send is closed, read by WritePump after.
+	closeCode   int
+	closeReason string
 }
 
 type Message struct {
-	ID        int    `json:"id"`
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	SenderID  int    `json:"senderId"`
-	Timestamp string `json:"timestamp"`
+	ID          int          `json:"id"`
+	Type        string       `json:"type"`
+	Room        string       `json:"room"`
+	Content     string       `json:"content"`
+	SenderID    int          `json:"senderId"`
+	ParentID    int          `json:"parentId,omitempty"`
+	ReplyCount  int          `json:"replyCount,omitempty"`
+	Timestamp   string       `json:"timestamp"`
+	EditedAt    string       `json:"editedAt,omitempty"`
+	Deleted     bool         `json:"deleted,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Reactions   []Reaction   `json:"reactions,omitempty"`
+	Mentions    []int        `json:"mentions,omitempty"`
+}
+
+// RoomMessage is an encoded frame addressed to every client in a room.
+type RoomMessage struct {
+	Room string
+	Data []byte
+}
+
+// UserMessage is an encoded frame addressed to every open connection of the
+// given users, whatever rooms they have joined.
+type UserMessage struct {
+	UserIDs []int
+	Data    []byte
+}
+
+type Subscription struct {
+	Client *Client
+	Room   string
+}
+
+// Eviction removes every connection of a user from a room, e.g. on a ban.
+type Eviction struct {
+	UserID int
+	Room   string
 }
 
 type Manager struct {
 	Clients    map[*Client]bool
-	Broadcast  chan []byte
+	Rooms      map[string]map[*Client]bool
+	Users      map[int]map[*Client]bool
+	Broadcast  chan RoomMessage
+	Direct     chan UserMessage
 	Register   chan *Client
 	Unregister chan *Client
+	Join       chan Subscription
+	Leave      chan Subscription
+	Evict      chan Eviction
+	Presence   chan PresenceUpdate
 	Mutex      sync.Mutex
+	DB         *sql.DB
+	Broker     Broker
+	Config     Config
+	// InstanceID tells this server instance apart in presence updates.
+	InstanceID string
+
+	// presence is who is in which room on every instance, this one included.
+	presence map[string]*instancePresence
+
+	// outbox holds messages for the broker in the order they were queued.
+	outbox      []BrokerMessage
+	outboxMutex sync.Mutex
+	outboxReady chan struct{}
 }
 
-func NewManager() *Manager {
+func NewManager(db *sql.DB, broker Broker) *Manager {
 	return &Manager{
-		Clients:    make(map[*Client]bool),
-		Broadcast:  make(chan []byte),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
+		DB:          db,
+		Broker:      broker,
+		Config:      ConfigFromEnv(),
+		Clients:     make(map[*Client]bool),
+		Rooms:       make(map[string]map[*Client]bool),
+		Users:       make(map[int]map[*Client]bool),
+		Broadcast:   make(chan RoomMessage),
+		Direct:      make(chan UserMessage),
+		Register:    make(chan *Client),
+		Unregister:  make(chan *Client),
+		Join:        make(chan Subscription),
+		Leave:       make(chan Subscription),
+		Evict:       make(chan Eviction),
+		Presence:    make(chan PresenceUpdate),
+		InstanceID:  newInstanceID(),
+		presence:    make(map[string]*instancePresence),
+		outboxReady: make(chan struct{}, 1),
 	}
 }
 
 func (m *Manager) Run() {
+	go m.runPublisher()
+
+	ticker := time.NewTicker(m.Config.PresenceInterval)
+	defer ticker.Stop()
+	m.queuePublish(BrokerMessage{Presence: &PresenceUpdate{Instance: m.InstanceID, Kind: presenceSync}})
+
 	for {
 		select {
 		case client := <-m.Register:
 			m.Mutex.Lock()
 			m.Clients[client] = true
+			if m.Users[client.UserID] == nil {
+				m.Users[client.UserID] = make(map[*Client]bool)
+			}
+			m.Users[client.UserID][client] = true
+			m.joinRoom(client, LobbyRoom)
 			m.Mutex.Unlock()
 
 		case client := <-m.Unregister:
-			if _, ok := m.Clients[client]; ok {
-				m.Mutex.Lock()
-				delete(m.Clients, client)
-				close(client.Send)
-				m.Mutex.Unlock()
+			m.Mutex.Lock()
+			m.removeClient(client, websocket.CloseNormalClosure, "")
+			m.Mutex.Unlock()
+
+		case sub := <-m.Join:
+			m.Mutex.Lock()
+			if _, ok := m.Clients[sub.Client]; ok {
+				m.joinRoom(sub.Client, sub.Room)
 			}
+			m.Mutex.Unlock()
+
+		case sub := <-m.Leave:
+			m.Mutex.Lock()
+			m.leaveRoom(sub.Client, sub.Room)
+			m.Mutex.Unlock()
+
+		case eviction := <-m.Evict:
+			m.Mutex.Lock()
+			data := EncodeFrame(FrameLeave, eviction.Room, "", PresencePayload{UserID: eviction.UserID})
+			for client := range m.Users[eviction.UserID] {
+				if client.Rooms[eviction.Room] {
+					m.leaveRoom(client, eviction.Room)
+					m.deliver(map[*Client]bool{client: true}, data)
+				}
+			}
+			m.Mutex.Unlock()
 
 		case message := <-m.Broadcast:
 			m.Mutex.Lock()
-			for client := range m.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(m.Clients, client)
+			m.deliver(m.Rooms[message.Room], message.Data)
+			m.Mutex.Unlock()
+
+		case message := <-m.Direct:
+			m.Mutex.Lock()
+			clients := make(map[*Client]bool)
+			for _, userID := range message.UserIDs {
+				for client := range m.Users[userID] {
+					clients[client] = true
 				}
 			}
+			m.deliver(clients, message.Data)
+			m.Mutex.Unlock()
+
+		case update := <-m.Presence:
+			m.Mutex.Lock()
+			m.applyPresence(update, time.Now())
+			m.Mutex.Unlock()
+
+		case now := <-ticker.C:
+			m.Mutex.Lock()
+			m.queuePublish(m.presenceSnapshot())
+			m.expirePresence(now)
 			m.Mutex.Unlock()
 		}
 	}
 }
+
+// Subscribe starts receiving frames from the broker. It must be called
+// before Run.
+func (m *Manager) Subscribe() error {
+	return m.Broker.Subscribe(m.receive)
+}
+
+// receive hands a frame from the broker to the run loop for delivery to this
+// instance's clients.
+func (m *Manager) receive(msg BrokerMessage) {
+	switch {
+	case msg.Presence != nil:
+		m.Presence <- *msg.Presence
+	case msg.Eviction != nil:
+		m.Evict <- *msg.Eviction
+	case len(msg.UserIDs) > 0:
+		m.Direct <- UserMessage{UserIDs: msg.UserIDs, Data: msg.Data}
+	case msg.Room != "":
+		m.Broadcast <- RoomMessage{Room: msg.Room, Data: msg.Data}
+	}
+}
+
+func (m *Manager) publish(msg BrokerMessage) {
+	if err := m.Broker.Publish(msg); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+// queuePublish hands a message to the publisher goroutine. It never blocks,
+// so the run loop can use it even though the broker may deliver straight
+// back into the run loop, and messages go out in the order they were queued.
+func (m *Manager) queuePublish(msg BrokerMessage) {
+	m.outboxMutex.Lock()
+	m.outbox = append(m.outbox, msg)
+	m.outboxMutex.Unlock()
+
+	select {
+	case m.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) runPublisher() {
+	for range m.outboxReady {
+		m.outboxMutex.Lock()
+		batch := m.outbox
+		m.outbox = nil
+		m.outboxMutex.Unlock()
+
+		for _, msg := range batch {
+			m.publish(msg)
+		}
+	}
+}
+
+// Publish sends a frame to everyone in a room, on every server instance.
+// Direct rooms have no members, so their frames go to both participants.
+func (m *Manager) Publish(room string, data []byte) {
+	if userOneID, userTwoID, err := ParseDirectRoom(room); err == nil {
+		m.publish(BrokerMessage{UserIDs: []int{userOneID, userTwoID}, Data: data})
+		return
+	}
+	m.publish(BrokerMessage{Room: room, Data: data})
+}
+
+// PublishEviction removes a user from a room on every server instance.
+func (m *Manager) PublishEviction(eviction Eviction) {
+	m.publish(BrokerMessage{Eviction: &eviction})
+}
+
+// deliver queues a frame for each client. Clients whose buffer is full are
+// not keeping up and are disconnected rather than allowed to stall everyone
+// else. Must be called with the mutex held.
+func (m *Manager) deliver(clients map[*Client]bool, data []byte) {
+	var dropped []*Client
+	for client := range clients {
+		select {
+		case client.Send <- data:
+		default:
+			dropped = append(dropped, client)
+		}
+	}
+
+	for _, client := range dropped {
+		m.removeClient(client, websocket.CloseTryAgainLater, "slow consumer")
+	}
+}
+
+// InRoom reports whether the client has joined the room.
+func (m *Manager) InRoom(client *Client, room string) bool {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	return client.Rooms[room]
+}
+
+// userInRoom reports whether any connection of the user, other than the
+// given client, is in the room.
+func (m *Manager) userInRoom(userID int, room string, except *Client) bool {
+	for client := range m.Users[userID] {
+		if client != except && client.Rooms[room] {
+			return true
+		}
+	}
+	return false
+}
+
+// joinRoom adds the client to the room and, if it is the user's first
+// connection there on this instance, announces it to every instance.
+func (m *Manager) joinRoom(client *Client, room string) {
+	if client.Rooms[room] {
+		return
+	}
+
+	online := m.userInRoom(client.UserID, room, client)
+	if m.Rooms[room] == nil {
+		m.Rooms[room] = make(map[*Client]bool)
+	}
+	m.Rooms[room][client] = true
+	client.Rooms[room] = true
+
+	if !online {
+		m.queuePresence(presenceOnline, room, client.UserID)
+	}
+}
+
+// leaveRoom removes the client from the room and, if it was the user's last
+// connection there on this instance, announces it to every instance.
+func (m *Manager) leaveRoom(client *Client, room string) {
+	if !client.Rooms[room] {
+		return
+	}
+
+	delete(m.Rooms[room], client)
+	if len(m.Rooms[room]) == 0 {
+		delete(m.Rooms, room)
+	}
+	delete(client.Rooms, room)
+
+	if !m.userInRoom(client.UserID, room, client) {
+		m.queuePresence(presenceOffline, room, client.UserID)
+	}
+}
+
+// removeClient forgets the client and closes its send channel, which makes
+// WritePump close the connection with the given code and reason. It is safe
+// to call more than once; only the first call has any effect.
+func (m *Manager) removeClient(client *Client, code int, reason string) {
+	if _, ok := m.Clients[client]; !ok {
+		return
+	}
+	delete(m.Clients, client)
+
+	for room := range client.Rooms {
+		m.leaveRoom(client, room)
+	}
+	delete(m.Users[client.UserID], client)
+	if len(m.Users[client.UserID]) == 0 {
+		delete(m.Users, client.UserID)
+	}
+	client.closeCode = code
+	client.closeReason = reason
+	close(client.Send)
+}
+
+// SendTo queues a frame for a single client, dropping it if the client has
+// already been removed or its buffer is full.
+func (m *Manager) SendTo(client *Client, data []byte) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	if _, ok := m.Clients[client]; !ok {
+		return
+	}
+	select {
+	case client.Send <- data:
+	default:
+	}
+}
@@ -0,0 +1,264 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"online-learning-golang/utils"
+)
+
+const (
+	FrameMention = "mention"
+
+	// MaxMentions caps how many users a single message can notify.
+	MaxMentions = 20
+
+	NotificationChatMention = "chat_mention"
+)
+
+// mentionPattern matches "@username" at the start of the content or after a
+// character that cannot be part of a username, so e-mail addresses are not
+// taken for mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w.@])@(\w{1,20})`)
+
+// MentionedUser is a user mentioned in a message who can see the room.
+type MentionedUser struct {
+	ID       int
+	Username string
+	Email    string
+}
+
+// ParseMentions returns the distinct usernames mentioned in content, in
+// lower case and in order of appearance.
+func ParseMentions(content string) []string {
+	seen := make(map[string]bool)
+	usernames := []string{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		username := strings.ToLower(match[1])
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+		if len(usernames) == MaxMentions {
+			break
+		}
+	}
+	return usernames
+}
+
+// ResolveMentions looks up the mentioned usernames and keeps the users, other
+// than the sender, who may read the room.
+func ResolveMentions(db *sql.DB, room string, senderID int, usernames []string) ([]MentionedUser, error) {
+	users := []MentionedUser{}
+	if len(usernames) == 0 {
+		return users, nil
+	}
+
+	args := make([]interface{}, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+
+	rows, err := db.Query(`
+		SELECT id, username, email, role
+		FROM users
+		WHERE LOWER(username) IN (`+placeholders(len(usernames))+`) AND deletedAt IS NULL
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mentioned users: %w", err)
+	}
+
+	type candidate struct {
+		MentionedUser
+		role string
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.ID, &c.Username, &c.Email, &c.role); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan mentioned user: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mentioned users: %w", err)
+	}
+
+	for _, c := range candidates {
+		if c.ID == senderID {
+			continue
+		}
+
+		var allowed bool
+		if IsDirectRoom(room) {
+			userOneID, userTwoID, err := ParseDirectRoom(room)
+			if err != nil {
+				return nil, err
+			}
+			allowed = c.ID == userOneID || c.ID == userTwoID
+		} else {
+			allowed, err = CanJoin(db, c.ID, c.role, room)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if allowed {
+			users = append(users, c.MentionedUser)
+		}
+	}
+
+	return users, nil
+}
+
+// SaveMentions records which users a message mentioned.
+func SaveMentions(db *sql.DB, messageID int, users []MentionedUser) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	args := []interface{}{}
+	for _, user := range users {
+		args = append(args, messageID, user.ID)
+	}
+
+	_, err := db.Exec(`
+		INSERT IGNORE INTO chat_mentions (messageId, userId)
+		VALUES `+strings.TrimSuffix(strings.Repeat("(?, ?),", len(users)), ","), args...)
+	if err != nil {
+		return fmt.Errorf("failed to save mentions: %w", err)
+	}
+	return nil
+}
+
+func queryMentions(db *sql.DB, messageIDs []int) (map[int][]int, error) {
+	mentions := make(map[int][]int)
+	if len(messageIDs) == 0 {
+		return mentions, nil
+	}
+
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(`
+		SELECT messageId, userId
+		FROM chat_mentions
+		WHERE messageId IN (`+placeholders(len(messageIDs))+`)
+		ORDER BY messageId, userId
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, userID int
+		if err := rows.Scan(&messageID, &userID); err != nil {
+			return nil, fmt.Errorf("failed to scan mention: %w", err)
+		}
+		mentions[messageID] = append(mentions[messageID], userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mentions: %w", err)
+	}
+
+	return mentions, nil
+}
+
+// loadMentions fills in the mentioned user IDs of messages that have not
+// been deleted.
+func loadMentions(db *sql.DB, messages []Message) error {
+	ids := []int{}
+	for _, msg := range messages {
+		if !msg.Deleted {
+			ids = append(ids, msg.ID)
+		}
+	}
+
+	mentions, err := queryMentions(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Mentions = mentions[messages[i].ID]
+	}
+	return nil
+}
+
+// CreateNotification stores an in-app notification about a message.
+func CreateNotification(db *sql.DB, userID int, kind string, msg Message) error {
+	_, err := db.Exec(`
+		INSERT INTO notifications (userId, type, actorId, room, messageId, content)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, kind, msg.SenderID, msg.Room, msg.ID, excerpt(msg.Content, 255))
+	if err != nil {
+		return fmt.Errorf("failed to create notification: %w", err)
+	}
+	return nil
+}
+
+func excerpt(content string, max int) string {
+	if utf8.RuneCountInString(content) <= max {
+		return content
+	}
+	return string([]rune(content)[:max-1]) + "…"
+}
+
+// NotifyMentions tells mentioned users about a message. Connected users get
+// a mention frame; the others get an in-app notification and, when
+// CHAT_MENTION_EMAIL is "true", an e-mail. Users connected to any server
+// instance count as connected.
+func (m *Manager) NotifyMentions(msg Message, users []MentionedUser) {
+	if len(users) == 0 {
+		return
+	}
+
+	userIDs := make([]int, len(users))
+	for i, user := range users {
+		userIDs[i] = user.ID
+	}
+	m.publish(BrokerMessage{UserIDs: userIDs, Data: EncodeFrame(FrameMention, msg.Room, "", msg)})
+
+	sendEmail := os.Getenv("CHAT_MENTION_EMAIL") == "true"
+	var senderName string
+	for _, user := range users {
+		if m.isOnline(user.ID) {
+			continue
+		}
+
+		if err := CreateNotification(m.DB, user.ID, NotificationChatMention, msg); err != nil {
+			log.Printf("error: %v", err)
+		}
+
+		if !sendEmail || user.Email == "" {
+			continue
+		}
+		if senderName == "" {
+			senderName = m.senderName(msg.SenderID)
+		}
+		if err := utils.SendMentionEmail(user.Email, senderName, msg.Room, msg.ID, excerpt(msg.Content, 500)); err != nil {
+			log.Printf("error: failed to send mention email: %v", err)
+		}
+	}
+}
+
+func (m *Manager) senderName(userID int) string {
+	users, err := GetUserSummaries(m.DB, []int{userID})
+	if err != nil || len(users) == 0 {
+		return "Someone"
+	}
+	if users[0].FullName != "" {
+		return users[0].FullName
+	}
+	return users[0].Username
+}
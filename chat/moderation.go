@@ -0,0 +1,231 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// EditWindow is how long senders may edit or delete their own messages.
+// Admins may delete any message at any time.
+const EditWindow = 15 * time.Minute
+
+const (
+	SanctionMute = "mute"
+	SanctionBan  = "ban"
+)
+
+// Sanction restricts a user in a room until it expires or is lifted. Muted
+// users can read but not post; banned users cannot join at all.
+type Sanction struct {
+	ID        int    `json:"id"`
+	Room      string `json:"room"`
+	UserID    int    `json:"userId"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	CreatedBy int    `json:"createdBy"`
+	ExpiresAt string `json:"expiresAt"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type storedMessage struct {
+	Message
+	CreatedAt time.Time
+}
+
+func getStoredMessage(db *sql.DB, messageID int) (*storedMessage, error) {
+	var msg storedMessage
+	var editedAt, deletedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, room, content, senderId, COALESCE(parentId, 0), createdAt, editedAt, deletedAt
+		FROM chat_messages
+		WHERE id = ?
+	`, messageID).Scan(&msg.ID, &msg.Room, &msg.Content, &msg.SenderID, &msg.ParentID, &msg.CreatedAt, &editedAt, &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Type = FrameMessage
+	msg.Timestamp = formatTimestamp(msg.CreatedAt)
+	if editedAt.Valid {
+		msg.EditedAt = formatTimestamp(editedAt.Time)
+	}
+	msg.Deleted = deletedAt.Valid
+
+	if !msg.Deleted {
+		attachments, err := queryAttachments(db, []int{msg.ID})
+		if err != nil {
+			return nil, err
+		}
+		msg.Attachments = attachments[msg.ID]
+	}
+	return &msg, nil
+}
+
+// EditMessage replaces the content of a message and records the previous
+// content in the audit log.
+func EditMessage(db *sql.DB, msg *Message, actorID int, content string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	editedAt := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE chat_messages
+		SET content = ?, editedAt = ?
+		WHERE id = ? AND deletedAt IS NULL
+	`, content, editedAt, msg.ID)
+	if err != nil {
+		return fmt.Errorf("failed to edit chat message: %w", err)
+	}
+
+	if err := insertAudit(tx, msg.ID, "edit", actorID, msg.Content); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	msg.Content = content
+	msg.EditedAt = formatTimestamp(editedAt)
+	return nil
+}
+
+// DeleteMessage soft-deletes a message. The content is kept in the audit log
+// but no longer returned in history.
+func DeleteMessage(db *sql.DB, msg *Message, actorID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE chat_messages
+		SET deletedAt = ?, deletedBy = ?
+		WHERE id = ? AND deletedAt IS NULL
+	`, time.Now().UTC(), actorID, msg.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete chat message: %w", err)
+	}
+
+	if err := insertAudit(tx, msg.ID, "delete", actorID, msg.Content); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	msg.Content = ""
+	msg.Deleted = true
+	msg.Attachments = nil
+	return nil
+}
+
+func insertAudit(tx *sql.Tx, messageID int, action string, actorID int, previousContent string) error {
+	_, err := tx.Exec(`
+		INSERT INTO chat_message_audits (messageId, action, actorId, previousContent)
+		VALUES (?, ?, ?, ?)
+	`, messageID, action, actorID, previousContent)
+	if err != nil {
+		return fmt.Errorf("failed to write chat audit log: %w", err)
+	}
+	return nil
+}
+
+// ActiveSanction returns the strongest unexpired sanction type for the user
+// in the room, or "" if there is none.
+func ActiveSanction(db *sql.DB, userID int, room string) (string, error) {
+	var sanction string
+	err := db.QueryRow(`
+		SELECT type
+		FROM chat_room_sanctions
+		WHERE userId = ? AND room = ? AND expiresAt > ? AND liftedAt IS NULL
+		ORDER BY type = 'ban' DESC
+		LIMIT 1
+	`, userID, room, time.Now().UTC()).Scan(&sanction)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check sanctions: %w", err)
+	}
+	return sanction, nil
+}
+
+func CreateSanction(db *sql.DB, sanction *Sanction, duration time.Duration) error {
+	createdAt := time.Now().UTC()
+	expiresAt := createdAt.Add(duration)
+
+	result, err := db.Exec(`
+		INSERT INTO chat_room_sanctions (room, userId, type, reason, createdBy, expiresAt, createdAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, sanction.Room, sanction.UserID, sanction.Type, sanction.Reason, sanction.CreatedBy, expiresAt, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to create sanction: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get sanction ID: %w", err)
+	}
+
+	sanction.ID = int(id)
+	sanction.ExpiresAt = formatTimestamp(expiresAt)
+	sanction.CreatedAt = formatTimestamp(createdAt)
+	return nil
+}
+
+// LiftSanction ends a sanction early. It reports false if the sanction does
+// not exist or was already lifted.
+func LiftSanction(db *sql.DB, sanctionID int) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE chat_room_sanctions
+		SET liftedAt = ?
+		WHERE id = ? AND liftedAt IS NULL
+	`, time.Now().UTC(), sanctionID)
+	if err != nil {
+		return false, fmt.Errorf("failed to lift sanction: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to lift sanction: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+func GetSanctions(db *sql.DB, room string) ([]Sanction, error) {
+	rows, err := db.Query(`
+		SELECT id, room, userId, type, reason, createdBy, expiresAt, createdAt
+		FROM chat_room_sanctions
+		WHERE room = ? AND expiresAt > ? AND liftedAt IS NULL
+		ORDER BY createdAt DESC
+	`, room, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sanctions: %w", err)
+	}
+	defer rows.Close()
+
+	sanctions := []Sanction{}
+	for rows.Next() {
+		var s Sanction
+		var expiresAt, createdAt time.Time
+		if err := rows.Scan(&s.ID, &s.Room, &s.UserID, &s.Type, &s.Reason, &s.CreatedBy, &expiresAt, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan sanction: %w", err)
+		}
+		s.ExpiresAt = formatTimestamp(expiresAt)
+		s.CreatedAt = formatTimestamp(createdAt)
+		sanctions = append(sanctions, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sanctions: %w", err)
+	}
+
+	return sanctions, nil
+}
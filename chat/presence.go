@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// Presence is shared between server instances through the broker. Each
+// instance announces when a user's first connection joins a room on it, or
+// their last one leaves, and every PresenceInterval publishes a snapshot of
+// all its rooms. The snapshots repair anything an instance missed and keep it
+// alive in the others' tables; an instance that has not been heard from for
+// presenceExpiryIntervals is taken to be gone, along with its users.
+//
+// Every manager applies the same updates in broker order, so each one can
+// tell its own clients when a user comes online or goes offline anywhere in
+// the cluster, without asking the others.
+
+// presenceExpiryIntervals is how many snapshots an instance may miss before
+// its users are considered offline.
+const presenceExpiryIntervals = 3
+
+// Presence update kinds.
+const (
+	presenceOnline   = "online"
+	presenceOffline  = "offline"
+	presenceSnapshot = "snapshot"
+	// presenceSync asks every other instance for its snapshot, so that a
+	// new instance does not wait a whole interval to learn who is online.
+	presenceSync = "sync"
+)
+
+// PresenceUpdate is one instance's presence news.
+type PresenceUpdate struct {
+	Instance string `json:"instance"`
+	Kind     string `json:"kind"`
+	Room     string `json:"room,omitempty"`
+	UserID   int    `json:"userId,omitempty"`
+	// Snapshot lists the users in each room of the instance. It replaces
+	// everything known about the instance.
+	Snapshot map[string][]int `json:"snapshot,omitempty"`
+}
+
+// instancePresence is what is known about the users of one instance.
+type instancePresence struct {
+	rooms    map[string]map[int]bool
+	lastSeen time.Time
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// queuePresence announces a change of the user's presence on this instance.
+func (m *Manager) queuePresence(kind, room string, userID int) {
+	m.queuePublish(BrokerMessage{Presence: &PresenceUpdate{
+		Instance: m.InstanceID,
+		Kind:     kind,
+		Room:     room,
+		UserID:   userID,
+	}})
+}
+
+// presenceSnapshot lists the users with a connection in each room of this
+// instance. Must be called with the mutex held.
+func (m *Manager) presenceSnapshot() BrokerMessage {
+	snapshot := make(map[string][]int)
+	for room, clients := range m.Rooms {
+		seen := make(map[int]bool)
+		for client := range clients {
+			if !seen[client.UserID] {
+				seen[client.UserID] = true
+				snapshot[room] = append(snapshot[room], client.UserID)
+			}
+		}
+		sort.Ints(snapshot[room])
+	}
+
+	return BrokerMessage{Presence: &PresenceUpdate{
+		Instance: m.InstanceID,
+		Kind:     presenceSnapshot,
+		Snapshot: snapshot,
+	}}
+}
+
+// applyPresence records an update from any instance, this one included. Must
+// be called with the mutex held.
+func (m *Manager) applyPresence(update PresenceUpdate, now time.Time) {
+	if update.Kind == presenceSync {
+		if update.Instance != m.InstanceID {
+			m.queuePublish(m.presenceSnapshot())
+		}
+		return
+	}
+
+	instance := m.presence[update.Instance]
+	if instance == nil {
+		instance = &instancePresence{rooms: make(map[string]map[int]bool)}
+		m.presence[update.Instance] = instance
+	}
+	instance.lastSeen = now
+
+	switch update.Kind {
+	case presenceOnline:
+		m.setPresence(instance, update.Room, update.UserID, true)
+	case presenceOffline:
+		m.setPresence(instance, update.Room, update.UserID, false)
+	case presenceSnapshot:
+		for room, users := range instance.rooms {
+			listed := make(map[int]bool)
+			for _, userID := range update.Snapshot[room] {
+				listed[userID] = true
+			}
+			for userID := range users {
+				if !listed[userID] {
+					m.setPresence(instance, room, userID, false)
+				}
+			}
+		}
+		for room, userIDs := range update.Snapshot {
+			for _, userID := range userIDs {
+				m.setPresence(instance, room, userID, true)
+			}
+		}
+	}
+}
+
+// expirePresence forgets the users of instances that have stopped sending
+// snapshots. Must be called with the mutex held.
+func (m *Manager) expirePresence(now time.Time) {
+	maxAge := presenceExpiryIntervals * m.Config.PresenceInterval
+	for id, instance := range m.presence {
+		if id == m.InstanceID || now.Sub(instance.lastSeen) <= maxAge {
+			continue
+		}
+		for room, users := range instance.rooms {
+			for userID := range users {
+				m.setPresence(instance, room, userID, false)
+			}
+		}
+		delete(m.presence, id)
+	}
+}
+
+// setPresence records whether the user is in the room on an instance, and
+// tells this instance's clients in the room when that changes whether the
+// user is there on any instance. Must be called with the mutex held.
+func (m *Manager) setPresence(instance *instancePresence, room string, userID int, online bool) {
+	if instance.rooms[room][userID] == online {
+		return
+	}
+
+	wasOnline := m.userOnline(room, userID)
+	if online {
+		if instance.rooms[room] == nil {
+			instance.rooms[room] = make(map[int]bool)
+		}
+		instance.rooms[room][userID] = true
+	} else {
+		delete(instance.rooms[room], userID)
+		if len(instance.rooms[room]) == 0 {
+			delete(instance.rooms, room)
+		}
+	}
+
+	if m.userOnline(room, userID) != wasOnline {
+		m.deliver(m.Rooms[room], EncodeFrame(FramePresence, room, "", PresencePayload{
+			UserID: userID,
+			Online: online,
+		}))
+	}
+}
+
+// userOnline reports whether the user is in the room on any instance. Must
+// be called with the mutex held.
+func (m *Manager) userOnline(room string, userID int) bool {
+	for _, instance := range m.presence {
+		if instance.rooms[room][userID] {
+			return true
+		}
+	}
+	return false
+}
+
+// OnlineUsers returns the IDs of users with at least one connection in the
+// room, on any server instance.
+func (m *Manager) OnlineUsers(room string) []int {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	seen := make(map[int]bool)
+	userIDs := []int{}
+	for _, instance := range m.presence {
+		for userID := range instance.rooms[room] {
+			if !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	sort.Ints(userIDs)
+	return userIDs
+}
+
+// isOnline reports whether the user has a connection to any server
+// instance.
+func (m *Manager) isOnline(userID int) bool {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	for _, instance := range m.presence {
+		for _, users := range instance.rooms {
+			if users[userID] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startTestManager runs a manager on the shared broker, standing in for one
+// server instance.
+func startTestManager(t *testing.T, broker Broker, interval time.Duration) *Manager {
+	t.Helper()
+
+	manager := NewManager(nil, broker)
+	manager.Config = testConfig()
+	manager.Config.PresenceInterval = interval
+	if err := manager.Subscribe(); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	go manager.Run()
+	return manager
+}
+
+// connect registers a client without a socket; frames for it pile up in its
+// send buffer.
+func connect(manager *Manager, userID int, rooms ...string) *Client {
+	client := &Client{UserID: userID, Send: make(chan []byte, 64), Rooms: make(map[string]bool)}
+	manager.Register <- client
+	for _, room := range rooms {
+		manager.Join <- Subscription{Client: client, Room: room}
+	}
+	return client
+}
+
+// presenceFrames drains the client's buffer and returns the presence frames
+// for the room.
+func presenceFrames(t *testing.T, client *Client, room string) []PresencePayload {
+	t.Helper()
+
+	frames := []PresencePayload{}
+	for {
+		select {
+		case data := <-client.Send:
+			var env Envelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				t.Fatalf("invalid frame: %v", err)
+			}
+			if env.Type != FramePresence || env.Room != room {
+				continue
+			}
+			var payload PresencePayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				t.Fatalf("invalid presence payload: %v", err)
+			}
+			frames = append(frames, payload)
+		default:
+			return frames
+		}
+	}
+}
+
+func onlineUsersAre(manager *Manager, room string, want ...int) func() bool {
+	return func() bool {
+		return reflect.DeepEqual(manager.OnlineUsers(room), append([]int{}, want...))
+	}
+}
+
+const testRoom = "class:1"
+
+func TestPresenceIsSharedBetweenInstances(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := startTestManager(t, broker, time.Minute)
+	b := startTestManager(t, broker, time.Minute)
+
+	observer := connect(b, 1, testRoom)
+	waitFor(t, time.Second, "observer online", onlineUsersAre(a, testRoom, 1))
+	presenceFrames(t, observer, testRoom)
+
+	user := connect(a, 2, testRoom)
+	waitFor(t, time.Second, "user online on the other instance", onlineUsersAre(b, testRoom, 1, 2))
+	if !b.isOnline(2) {
+		t.Error("user connected to another instance is not online")
+	}
+	if got := presenceFrames(t, observer, testRoom); !reflect.DeepEqual(got, []PresencePayload{{UserID: 2, Online: true}}) {
+		t.Errorf("observer got %+v", got)
+	}
+
+	a.Leave <- Subscription{Client: user, Room: testRoom}
+	waitFor(t, time.Second, "user offline on the other instance", onlineUsersAre(b, testRoom, 1))
+	if got := presenceFrames(t, observer, testRoom); !reflect.DeepEqual(got, []PresencePayload{{UserID: 2, Online: false}}) {
+		t.Errorf("observer got %+v", got)
+	}
+}
+
+func TestLeavingOneInstanceKeepsUserOnline(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := startTestManager(t, broker, time.Minute)
+	b := startTestManager(t, broker, time.Minute)
+
+	observer := connect(b, 1, testRoom)
+	onA := connect(a, 2, testRoom)
+	onB := connect(b, 2, testRoom)
+	waitFor(t, time.Second, "user online", onlineUsersAre(b, testRoom, 1, 2))
+	waitFor(t, time.Second, "user online", onlineUsersAre(a, testRoom, 1, 2))
+	presenceFrames(t, observer, testRoom)
+
+	// Still connected on A, so leaving on B must not announce them offline
+	b.Leave <- Subscription{Client: onB, Room: testRoom}
+	b.Unregister <- onB
+	time.Sleep(100 * time.Millisecond)
+	if got := b.OnlineUsers(testRoom); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("online users = %v", got)
+	}
+	if got := presenceFrames(t, observer, testRoom); len(got) != 0 {
+		t.Errorf("observer got %+v", got)
+	}
+
+	a.Unregister <- onA
+	waitFor(t, time.Second, "user offline", onlineUsersAre(b, testRoom, 1))
+	if b.isOnline(2) {
+		t.Error("disconnected user is still online")
+	}
+	if got := presenceFrames(t, observer, testRoom); !reflect.DeepEqual(got, []PresencePayload{{UserID: 2, Online: false}}) {
+		t.Errorf("observer got %+v", got)
+	}
+}
+
+func TestNewInstanceLearnsPresence(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := startTestManager(t, broker, time.Minute)
+	connect(a, 2, testRoom)
+	waitFor(t, time.Second, "user online", onlineUsersAre(a, testRoom, 2))
+
+	// Long before the next snapshot, the sync request fills in the newcomer
+	b := startTestManager(t, broker, time.Minute)
+	waitFor(t, time.Second, "user online on the new instance", onlineUsersAre(b, testRoom, 2))
+}
+
+func TestSilentInstanceExpires(t *testing.T) {
+	broker := NewMemoryBroker()
+	interval := 100 * time.Millisecond
+	a := startTestManager(t, broker, interval)
+	observer := connect(a, 1, testRoom)
+	waitFor(t, time.Second, "observer online", onlineUsersAre(a, testRoom, 1))
+
+	// An instance that announces a user and then dies without a word
+	broker.Publish(BrokerMessage{Presence: &PresenceUpdate{Instance: "gone", Kind: presenceOnline, Room: testRoom, UserID: 2}})
+	waitFor(t, time.Second, "user online", onlineUsersAre(a, testRoom, 1, 2))
+	presenceFrames(t, observer, testRoom)
+
+	waitFor(t, time.Second, "dead instance to expire", onlineUsersAre(a, testRoom, 1))
+	if got := presenceFrames(t, observer, testRoom); !reflect.DeepEqual(got, []PresencePayload{{UserID: 2, Online: false}}) {
+		t.Errorf("observer got %+v", got)
+	}
+}
+
+func TestSnapshotRepairsMissedUpdates(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := startTestManager(t, broker, time.Minute)
+
+	broker.Publish(BrokerMessage{Presence: &PresenceUpdate{Instance: "other", Kind: presenceOnline, Room: testRoom, UserID: 2}})
+	waitFor(t, time.Second, "user online", onlineUsersAre(a, testRoom, 2))
+
+	// The offline update was lost; the next snapshot no longer lists the user
+	broker.Publish(BrokerMessage{Presence: &PresenceUpdate{
+		Instance: "other",
+		Kind:     presenceSnapshot,
+		Snapshot: map[string][]int{testRoom: {3}},
+	}})
+	waitFor(t, time.Second, "snapshot to apply", onlineUsersAre(a, testRoom, 3))
+}
@@ -0,0 +1,251 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ProtocolVersion is the envelope version spoken by the server. Clients may
+// omit "v", in which case the current version is assumed.
+const ProtocolVersion = 1
+
+const (
+	FrameMessage  = "message"
+	FrameTyping   = "typing"
+	FrameRead     = "read"
+	FrameEdit     = "edit"
+	FrameDelete   = "delete"
+	FrameReact    = "react"
+	FrameUnreact  = "unreact"
+	FrameJoin     = "join"
+	FrameLeave    = "leave"
+	FramePresence = "presence"
+	FrameAck      = "ack"
+	FrameError    = "error"
+)
+
+const (
+	MaxContentLength     = 4000
+	MaxClientMsgIDLength = 64
+	MaxEmojiLength       = 16
+)
+
+// Error codes carried in error frames.
+const (
+	ErrBadFrame     = "bad_frame"
+	ErrBadVersion   = "bad_version"
+	ErrUnknownType  = "unknown_type"
+	ErrInvalidRoom  = "invalid_room"
+	ErrForbidden    = "forbidden"
+	ErrNotFound     = "not_found"
+	ErrInvalidInput = "invalid_input"
+	ErrUnsupported  = "unsupported"
+	ErrInternal     = "internal"
+)
+
+// Envelope wraps every frame in both directions.
+type Envelope struct {
+	Version     int             `json:"v"`
+	Type        string          `json:"type"`
+	Room        string          `json:"room,omitempty"`
+	ClientMsgID string          `json:"clientMsgId,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type MessagePayload struct {
+	Content     string `json:"content"`
+	To          int    `json:"to,omitempty"`
+	ParentID    int    `json:"parentId,omitempty"`
+	Attachments []int  `json:"attachments,omitempty"`
+}
+
+type TypingPayload struct {
+	UserID int  `json:"userId,omitempty"`
+	Typing bool `json:"typing"`
+}
+
+type ReadPayload struct {
+	UserID    int `json:"userId,omitempty"`
+	MessageID int `json:"messageId"`
+}
+
+type EditPayload struct {
+	MessageID int    `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+type DeletePayload struct {
+	MessageID int `json:"messageId"`
+	UserID    int `json:"userId,omitempty"`
+}
+
+// ReactionPayload is sent by clients to add or remove a reaction, and
+// broadcast back with the acting user and the message's updated counts.
+type ReactionPayload struct {
+	MessageID int        `json:"messageId"`
+	Emoji     string     `json:"emoji"`
+	UserID    int        `json:"userId,omitempty"`
+	Reactions []Reaction `json:"reactions,omitempty"`
+}
+
+type AckPayload struct {
+	MessageID int    `json:"messageId,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type PresencePayload struct {
+	UserID int  `json:"userId"`
+	Online bool `json:"online"`
+}
+
+// ProtocolError is returned by frame handlers and sent back to the client as
+// an error frame.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+func frameErrorf(code, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// DecodeEnvelope parses and validates the envelope of an inbound frame. The
+// payload is validated by the handler for its type.
+func DecodeEnvelope(data []byte) (Envelope, *ProtocolError) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return env, frameErrorf(ErrBadFrame, "frame must be a JSON envelope")
+	}
+
+	if env.Version == 0 {
+		env.Version = ProtocolVersion
+	}
+	if env.Version != ProtocolVersion {
+		return env, frameErrorf(ErrBadVersion, "unsupported protocol version %d", env.Version)
+	}
+
+	if len(env.ClientMsgID) > MaxClientMsgIDLength {
+		return env, frameErrorf(ErrInvalidInput, "clientMsgId must be at most %d characters", MaxClientMsgIDLength)
+	}
+
+	switch env.Type {
+	case FrameMessage, FrameTyping, FrameRead, FrameEdit, FrameDelete, FrameReact, FrameUnreact, FrameJoin, FrameLeave:
+	case "":
+		return env, frameErrorf(ErrBadFrame, "frame type is required")
+	default:
+		return env, frameErrorf(ErrUnknownType, "unknown frame type: %s", env.Type)
+	}
+
+	return env, nil
+}
+
+func decodePayload(env Envelope, v interface{}) *ProtocolError {
+	if len(env.Payload) == 0 {
+		return frameErrorf(ErrInvalidInput, "payload is required for %s frames", env.Type)
+	}
+	if err := json.Unmarshal(env.Payload, v); err != nil {
+		return frameErrorf(ErrInvalidInput, "invalid payload for %s frame", env.Type)
+	}
+	return nil
+}
+
+func validateContent(content string) *ProtocolError {
+	if strings.TrimSpace(content) == "" {
+		return frameErrorf(ErrInvalidInput, "content is required")
+	}
+	if utf8.RuneCountInString(content) > MaxContentLength {
+		return frameErrorf(ErrInvalidInput, "content must be at most %d characters", MaxContentLength)
+	}
+	return nil
+}
+
+func (p MessagePayload) validate() *ProtocolError {
+	if p.To < 0 {
+		return frameErrorf(ErrInvalidInput, "invalid recipient")
+	}
+	if p.ParentID < 0 {
+		return frameErrorf(ErrInvalidInput, "invalid parentId")
+	}
+
+	if len(p.Attachments) == 0 {
+		return validateContent(p.Content)
+	}
+	if len(p.Attachments) > MaxAttachments {
+		return frameErrorf(ErrInvalidInput, "at most %d attachments per message", MaxAttachments)
+	}
+	seen := make(map[int]bool)
+	for _, id := range p.Attachments {
+		if id < 1 || seen[id] {
+			return frameErrorf(ErrInvalidInput, "invalid attachment")
+		}
+		seen[id] = true
+	}
+	if utf8.RuneCountInString(p.Content) > MaxContentLength {
+		return frameErrorf(ErrInvalidInput, "content must be at most %d characters", MaxContentLength)
+	}
+	return nil
+}
+
+func (p ReadPayload) validate() *ProtocolError {
+	if p.MessageID < 1 {
+		return frameErrorf(ErrInvalidInput, "messageId is required")
+	}
+	return nil
+}
+
+func (p EditPayload) validate() *ProtocolError {
+	if p.MessageID < 1 {
+		return frameErrorf(ErrInvalidInput, "messageId is required")
+	}
+	return validateContent(p.Content)
+}
+
+func (p DeletePayload) validate() *ProtocolError {
+	if p.MessageID < 1 {
+		return frameErrorf(ErrInvalidInput, "messageId is required")
+	}
+	return nil
+}
+
+func (p ReactionPayload) validate() *ProtocolError {
+	if p.MessageID < 1 {
+		return frameErrorf(ErrInvalidInput, "messageId is required")
+	}
+	if p.Emoji == "" || utf8.RuneCountInString(p.Emoji) > MaxEmojiLength {
+		return frameErrorf(ErrInvalidInput, "emoji must be 1 to %d characters", MaxEmojiLength)
+	}
+	for _, r := range p.Emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return frameErrorf(ErrInvalidInput, "emoji must not contain spaces")
+		}
+	}
+	return nil
+}
+
+// EncodeFrame builds an outbound envelope.
+func EncodeFrame(frameType, room, clientMsgID string, payload interface{}) []byte {
+	env := Envelope{
+		Version:     ProtocolVersion,
+		Type:        frameType,
+		Room:        room,
+		ClientMsgID: clientMsgID,
+	}
+	if payload != nil {
+		env.Payload, _ = json.Marshal(payload)
+	}
+
+	data, _ := json.Marshal(env)
+	return data
+}
@@ -0,0 +1,134 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// MaxReactionsPerUser caps how many different emoji one user can put on a
+// single message.
+const MaxReactionsPerUser = 10
+
+var ErrTooManyReactions = fmt.Errorf("at most %d reactions per message", MaxReactionsPerUser)
+
+// Reaction is the number of users who reacted to a message with an emoji.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+// AddReaction records a reaction. It reports false if the user had already
+// reacted with that emoji.
+func AddReaction(db *sql.DB, messageID, userID int, emoji string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM chat_message_reactions
+		WHERE messageId = ? AND userId = ?
+	`, messageID, userID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to count reactions: %w", err)
+	}
+	if count >= MaxReactionsPerUser {
+		return false, ErrTooManyReactions
+	}
+
+	result, err := db.Exec(`
+		INSERT IGNORE INTO chat_message_reactions (messageId, userId, emoji)
+		VALUES (?, ?, ?)
+	`, messageID, userID, emoji)
+	if err != nil {
+		return false, fmt.Errorf("failed to add reaction: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to add reaction: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// RemoveReaction deletes a reaction. It reports false if there was none.
+func RemoveReaction(db *sql.DB, messageID, userID int, emoji string) (bool, error) {
+	result, err := db.Exec(`
+		DELETE FROM chat_message_reactions
+		WHERE messageId = ? AND userId = ? AND emoji = ?
+	`, messageID, userID, emoji)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove reaction: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove reaction: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+func queryReactions(db *sql.DB, messageIDs []int) (map[int][]Reaction, error) {
+	reactions := make(map[int][]Reaction)
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query(`
+		SELECT messageId, emoji, COUNT(*)
+		FROM chat_message_reactions
+		WHERE messageId IN (`+placeholders(len(messageIDs))+`)
+		GROUP BY messageId, emoji
+		ORDER BY messageId, MIN(createdAt), emoji
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Reaction
+		var messageID int
+		if err := rows.Scan(&messageID, &r.Emoji, &r.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan reaction: %w", err)
+		}
+		reactions[messageID] = append(reactions[messageID], r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reactions: %w", err)
+	}
+
+	return reactions, nil
+}
+
+// GetReactions returns the aggregated reactions of a message.
+func GetReactions(db *sql.DB, messageID int) ([]Reaction, error) {
+	reactions, err := queryReactions(db, []int{messageID})
+	if err != nil {
+		return nil, err
+	}
+	return reactions[messageID], nil
+}
+
+// loadReactions fills in the reactions of messages that have not been
+// deleted.
+func loadReactions(db *sql.DB, messages []Message) error {
+	ids := []int{}
+	for _, msg := range messages {
+		if !msg.Deleted {
+			ids = append(ids, msg.ID)
+		}
+	}
+
+	reactions, err := queryReactions(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type ReadState struct {
+	UserID            int `json:"userId"`
+	LastReadMessageID int `json:"lastReadMessageId"`
+}
+
+// MarkRead moves the user's read position in a room forward; it never moves
+// backwards if an older message is reported after a newer one.
+func MarkRead(db *sql.DB, userID int, room string, messageID int) error {
+	_, err := db.Exec(`
+		INSERT INTO chat_read_states (userId, room, lastReadMessageId)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE lastReadMessageId = GREATEST(lastReadMessageId, VALUES(lastReadMessageId))
+	`, userID, room, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to mark messages as read: %w", err)
+	}
+	return nil
+}
+
+// MessageInRoom reports whether a message belongs to the room.
+func MessageInRoom(db *sql.DB, messageID int, room string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM chat_messages WHERE id = ? AND room = ?", messageID, room).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check message: %w", err)
+	}
+	return exists, nil
+}
+
+// GetUnreadCounts returns, for each of the given rooms, how many messages
+// from other users are newer than the user's read position. Rooms with
+// nothing unread are left out. Each room is one range of the (room, id)
+// index, so only unread messages are read.
+func GetUnreadCounts(db *sql.DB, userID int, rooms []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	if len(rooms) == 0 {
+		return counts, nil
+	}
+
+	lastRead, err := getReadPositions(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make([]string, len(rooms))
+	args := []interface{}{userID}
+	for i, room := range rooms {
+		ranges[i] = "(room = ? AND id > ?)"
+		args = append(args, room, lastRead[room])
+	}
+
+	rows, err := db.Query(`
+		SELECT room, COUNT(*)
+		FROM chat_messages
+		WHERE senderId <> ?
+		AND deletedAt IS NULL
+		AND (`+strings.Join(ranges, " OR ")+`)
+		GROUP BY room
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unread counts: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var room string
+		var count int
+		if err := rows.Scan(&room, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan unread count: %w", err)
+		}
+		counts[room] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read unread counts: %w", err)
+	}
+
+	return counts, nil
+}
+
+// getReadPositions returns the user's last read message per room.
+func getReadPositions(db *sql.DB, userID int) (map[string]int, error) {
+	rows, err := db.Query("SELECT room, lastReadMessageId FROM chat_read_states WHERE userId = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query read positions: %w", err)
+	}
+	defer rows.Close()
+
+	positions := make(map[string]int)
+	for rows.Next() {
+		var room string
+		var messageID int
+		if err := rows.Scan(&room, &messageID); err != nil {
+			return nil, fmt.Errorf("failed to scan read position: %w", err)
+		}
+		positions[room] = messageID
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read read positions: %w", err)
+	}
+
+	return positions, nil
+}
+
+func GetReadStates(db *sql.DB, room string) ([]ReadState, error) {
+	rows, err := db.Query(`
+		SELECT userId, lastReadMessageId
+		FROM chat_read_states
+		WHERE room = ?
+		ORDER BY lastReadMessageId DESC
+	`, room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query read states: %w", err)
+	}
+	defer rows.Close()
+
+	states := []ReadState{}
+	for rows.Next() {
+		var state ReadState
+		if err := rows.Scan(&state.UserID, &state.LastReadMessageID); err != nil {
+			return nil, fmt.Errorf("failed to scan read state: %w", err)
+		}
+		states = append(states, state)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read read states: %w", err)
+	}
+
+	return states, nil
+}
@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultRedisChannel = "chat:events"
+
+// RedisBroker shares frames between server instances over Redis pub/sub.
+// Messages published while an instance is disconnected from Redis are lost
+// for that instance; clients recover through the history endpoints.
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+func NewRedisBroker(url, channel string) (*RedisBroker, error) {
+	if url == "" {
+		return nil, fmt.Errorf("REDIS_URL not set in environment")
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not ping Redis: %w", err)
+	}
+
+	if channel == "" {
+		channel = defaultRedisChannel
+	}
+
+	return &RedisBroker{client: client, channel: channel}, nil
+}
+
+func (b *RedisBroker) Publish(msg BrokerMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode broker message: %w", err)
+	}
+
+	if err := b.client.Publish(context.Background(), b.channel, data).Err(); err != nil {
+		return fmt.Errorf("failed to publish to Redis: %w", err)
+	}
+	return nil
+}
+
+func (b *RedisBroker) Subscribe(handler func(BrokerMessage)) error {
+	ctx := context.Background()
+	b.pubsub = b.client.Subscribe(ctx, b.channel)
+
+	// Wait for the subscription to be confirmed so nothing published right
+	// after startup is missed.
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe to Redis: %w", err)
+	}
+
+	go func() {
+		for redisMsg := range b.pubsub.Channel() {
+			var msg BrokerMessage
+			if err := json.Unmarshal([]byte(redisMsg.Payload), &msg); err != nil {
+				log.Printf("error: invalid broker message: %v", err)
+				continue
+			}
+			handler(msg)
+		}
+	}()
+
+	return nil
+}
+
+func (b *RedisBroker) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.client.Close()
+}
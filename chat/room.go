@@ -0,0 +1,143 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Room names are "lobby", "course:<id>", "class:<id>" or "subject:<id>".
+const (
+	LobbyRoom   = "lobby"
+	RoomCourse  = "course"
+	RoomClass   = "class"
+	RoomSubject = "subject"
+)
+
+type Room struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	UnreadCount int    `json:"unreadCount"`
+}
+
+func ParseRoom(room string) (string, int, error) {
+	if room == LobbyRoom {
+		return LobbyRoom, 0, nil
+	}
+
+	kind, idStr, found := strings.Cut(room, ":")
+	if !found {
+		return "", 0, fmt.Errorf("invalid room: %s", room)
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 1 {
+		return "", 0, fmt.Errorf("invalid room: %s", room)
+	}
+
+	switch kind {
+	case RoomCourse, RoomClass, RoomSubject:
+		return kind, id, nil
+	default:
+		return "", 0, fmt.Errorf("invalid room: %s", room)
+	}
+}
+
+// CanJoin reports whether a user may read and post in a room. Course rooms
+// are limited to enrolled users and admins; class and subject rooms are open
+// to everyone, like the documents they belong to.
+func CanJoin(db *sql.DB, userID int, role string, room string) (bool, error) {
+	kind, id, err := ParseRoom(room)
+	if err != nil {
+		return false, err
+	}
+
+	var allowed bool
+	switch kind {
+	case LobbyRoom:
+		return true, nil
+	case RoomCourse:
+		if role == "admin" {
+			err = db.QueryRow("SELECT COUNT(*) > 0 FROM courses WHERE id = ?", id).Scan(&allowed)
+		} else {
+			err = db.QueryRow("SELECT COUNT(*) > 0 FROM user_courses WHERE userId = ? AND courseId = ?", userID, id).Scan(&allowed)
+		}
+	case RoomClass:
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM classes WHERE id = ?", id).Scan(&allowed)
+	case RoomSubject:
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM subjects WHERE id = ?", id).Scan(&allowed)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check room access: %w", err)
+	}
+
+	return allowed, nil
+}
+
+func GetRooms(db *sql.DB, userID int, role string) ([]Room, error) {
+	rooms := []Room{{ID: LobbyRoom, Type: LobbyRoom, Name: "Lobby"}}
+
+	courseQuery := `
+		SELECT c.id, c.title
+		FROM courses c
+		JOIN user_courses uc ON uc.courseId = c.id
+		WHERE uc.userId = ?
+		ORDER BY c.id`
+	args := []interface{}{userID}
+	if role == "admin" {
+		courseQuery = `SELECT id, title FROM courses ORDER BY id`
+		args = nil
+	}
+
+	queries := []struct {
+		kind  string
+		query string
+		args  []interface{}
+	}{
+		{RoomCourse, courseQuery, args},
+		{RoomClass, `SELECT id, name FROM classes ORDER BY id`, nil},
+		{RoomSubject, `
+			SELECT s.id, CONCAT(s.name, ' - ', cl.name)
+			FROM subjects s
+			JOIN classes cl ON cl.id = s.classId
+			ORDER BY s.id`, nil},
+	}
+
+	for _, q := range queries {
+		rows, err := db.Query(q.query, q.args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s rooms: %w", q.kind, err)
+		}
+
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan %s room: %w", q.kind, err)
+			}
+			rooms = append(rooms, Room{ID: fmt.Sprintf("%s:%d", q.kind, id), Type: q.kind, Name: name})
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s rooms: %w", q.kind, err)
+		}
+	}
+
+	ids := make([]string, len(rooms))
+	for i, room := range rooms {
+		ids[i] = room.ID
+	}
+	unread, err := GetUnreadCounts(db, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rooms {
+		rooms[i].UnreadCount = unread[rooms[i].ID]
+	}
+
+	return rooms, nil
+}
@@ -0,0 +1,232 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func SaveMessage(db *sql.DB, msg *Message) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertMessage(tx, msg); err != nil {
+		return err
+	}
+	if err := claimAttachments(tx, msg); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func insertMessage(db execer, msg *Message) error {
+	createdAt := time.Now().UTC()
+
+	var parentID sql.NullInt64
+	if msg.ParentID > 0 {
+		parentID = sql.NullInt64{Int64: int64(msg.ParentID), Valid: true}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO chat_messages (room, senderId, parentId, content, createdAt)
+		VALUES (?, ?, ?, ?, ?)
+	`, msg.Room, msg.SenderID, parentID, msg.Content, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to save chat message: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get chat message ID: %w", err)
+	}
+
+	msg.ID = int(id)
+	msg.Timestamp = formatTimestamp(createdAt)
+	return nil
+}
+
+// messageColumns is the column list understood by scanMessages, selected
+// from chat_messages aliased as m. Deleted messages keep their place in
+// history but lose their content.
+const messageColumns = `m.id, m.room, IF(m.deletedAt IS NULL, m.content, ''), m.senderId, COALESCE(m.parentId, 0),
+	(SELECT COUNT(*) FROM chat_messages r WHERE r.parentId = m.id AND r.deletedAt IS NULL),
+	m.createdAt, m.editedAt, m.deletedAt IS NOT NULL`
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		var createdAt time.Time
+		var editedAt sql.NullTime
+		if err := rows.Scan(&msg.ID, &msg.Room, &msg.Content, &msg.SenderID, &msg.ParentID, &msg.ReplyCount, &createdAt, &editedAt, &msg.Deleted); err != nil {
+			return nil, fmt.Errorf("failed to scan chat message: %w", err)
+		}
+		msg.Type = FrameMessage
+		msg.Timestamp = formatTimestamp(createdAt)
+		if editedAt.Valid {
+			msg.EditedAt = formatTimestamp(editedAt.Time)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chat messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// loadDetails fills in the attachments, reactions and mentions of messages.
+func loadDetails(db *sql.DB, messages []Message) error {
+	if err := loadAttachments(db, messages); err != nil {
+		return err
+	}
+	if err := loadReactions(db, messages); err != nil {
+		return err
+	}
+	return loadMentions(db, messages)
+}
+
+func reverseMessages(messages []Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+// GetMessages returns up to limit messages of a room, newest first. With
+// before set, only messages older than that ID are returned; with after set,
+// the oldest messages newer than that ID. Message IDs only grow, so pages
+// stay stable while new messages arrive.
+func GetMessages(db *sql.DB, room string, before, after, limit int) ([]Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM chat_messages m WHERE m.room = ?`
+	args := []interface{}{room}
+
+	order := "DESC"
+	if before > 0 {
+		query += " AND m.id < ?"
+		args = append(args, before)
+	}
+	if after > 0 {
+		query += " AND m.id > ?"
+		args = append(args, after)
+		if before == 0 {
+			order = "ASC"
+		}
+	}
+	query += " ORDER BY m.id " + order + " LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat messages: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if order == "ASC" {
+		reverseMessages(messages)
+	}
+	if err := loadDetails(db, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+type SearchQuery struct {
+	Room     string
+	Text     string
+	SenderID int
+	From     time.Time
+	To       time.Time
+	Before   int
+	Limit    int
+}
+
+// SearchMessages runs a full-text search over non-deleted messages of a
+// room, newest first.
+func SearchMessages(db *sql.DB, q SearchQuery) ([]Message, error) {
+	query := `SELECT ` + messageColumns + `
+		FROM chat_messages m
+		WHERE m.room = ? AND m.deletedAt IS NULL`
+	args := []interface{}{q.Room}
+
+	if q.Text != "" {
+		query += " AND MATCH(m.content) AGAINST(? IN NATURAL LANGUAGE MODE)"
+		args = append(args, q.Text)
+	}
+	if q.SenderID > 0 {
+		query += " AND m.senderId = ?"
+		args = append(args, q.SenderID)
+	}
+	if !q.From.IsZero() {
+		query += " AND m.createdAt >= ?"
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		query += " AND m.createdAt < ?"
+		args = append(args, q.To.UTC())
+	}
+	if q.Before > 0 {
+		query += " AND m.id < ?"
+		args = append(args, q.Before)
+	}
+	query += " ORDER BY m.id DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search chat messages: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadDetails(db, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// GetMessageContext returns the message with up to size messages on each
+// side of it in its room, oldest first.
+func GetMessageContext(db *sql.DB, room string, messageID int, size int) ([]Message, error) {
+	older, err := GetMessages(db, room, messageID+1, 0, size+1)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := GetMessages(db, room, 0, messageID, size)
+	if err != nil {
+		return nil, err
+	}
+
+	reverseMessages(older)
+	reverseMessages(newer)
+	return append(older, newer...), nil
+}
+
+// MessageRoom returns the room a message was posted in.
+func MessageRoom(db *sql.DB, messageID int) (string, error) {
+	var room string
+	err := db.QueryRow("SELECT room FROM chat_messages WHERE id = ?", messageID).Scan(&room)
+	return room, err
+}
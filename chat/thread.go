@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrParentUnavailable is returned when a reply points at a message that
+// does not exist, was deleted or belongs to another room.
+var ErrParentUnavailable = errors.New("parent message not found")
+
+// Thread is a top-level message with its replies, oldest first. Threads are
+// one level deep: replying to a reply attaches to the same root.
+type Thread struct {
+	Root    Message   `json:"root"`
+	Replies []Message `json:"replies"`
+}
+
+// threadRoot returns the ID of the message a reply to messageID should
+// attach to, and the room the message is in.
+func threadRoot(db *sql.DB, messageID int) (int, string, bool, error) {
+	var room string
+	var parentID int
+	var deleted bool
+	err := db.QueryRow(`
+		SELECT room, COALESCE(parentId, 0), deletedAt IS NOT NULL
+		FROM chat_messages
+		WHERE id = ?
+	`, messageID).Scan(&room, &parentID, &deleted)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	if parentID > 0 {
+		return parentID, room, deleted, nil
+	}
+	return messageID, room, deleted, nil
+}
+
+// ResolveParent checks that a reply in room may point at parentID and returns
+// the root of its thread.
+func ResolveParent(db *sql.DB, room string, parentID int) (int, error) {
+	rootID, parentRoom, deleted, err := threadRoot(db, parentID)
+	if err == sql.ErrNoRows {
+		return 0, ErrParentUnavailable
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load parent message: %w", err)
+	}
+	if deleted || parentRoom != room {
+		return 0, ErrParentUnavailable
+	}
+	return rootID, nil
+}
+
+// GetThread returns the thread a message belongs to, with up to limit
+// replies newer than after. It returns sql.ErrNoRows if the message does not
+// exist.
+func GetThread(db *sql.DB, messageID, after, limit int) (*Thread, error) {
+	rootID, _, _, err := threadRoot(db, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT `+messageColumns+` FROM chat_messages m WHERE m.id = ?`, rootID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat messages: %w", err)
+	}
+	roots, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err = db.Query(`
+		SELECT `+messageColumns+`
+		FROM chat_messages m
+		WHERE m.parentId = ? AND m.id > ?
+		ORDER BY m.id ASC
+		LIMIT ?
+	`, rootID, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chat replies: %w", err)
+	}
+	replies, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadDetails(db, roots); err != nil {
+		return nil, err
+	}
+	if err := loadDetails(db, replies); err != nil {
+		return nil, err
+	}
+
+	return &Thread{Root: roots[0], Replies: replies}, nil
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"online-learning-golang/auth"
+	"online-learning-golang/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAPIKeys godoc
+// @Summary List API keys
+// @Description List the active API keys of the current user. The keys themselves are never shown again after creation
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} models.APIKey
+// @Failure 401 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /auth/api-keys [get]
+func GetAPIKeys(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		keys, err := auth.GetAPIKeys(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to fetch API keys"})
+			return
+		}
+
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+// CreateAPIKey godoc
+// @Summary Create an API key
+// @Description Create a personal API key for scripts and integrations, sent as "Authorization: Bearer <key>". Scopes are read (GET requests), write (other requests) and admin (admin rights, admins only). Keys expire after expiresInDays, 90 by default and at most 365. The key is only returned in this response
+// @Tags Authentication
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body models.CreateAPIKeyRequest true "Name, scopes and lifetime of the key"
+// @Success 201 {object} models.CreateAPIKeyResponse
+// @Failure 400 {object} models.Error
+// @Failure 401 {object} models.Error
+// @Failure 403 {object} models.Error "Admin scope or API key authentication not allowed"
+// @Failure 409 {object} models.Error "Too many API keys"
+// @Failure 500 {object} models.Error
+// @Router /auth/api-keys [post]
+func CreateAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		var req models.CreateAPIKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid request format"})
+			return
+		}
+
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len([]rune(name)) > 100 {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Name is required and must be at most 100 characters"})
+			return
+		}
+
+		scopes, err := auth.NormalizeAPIKeyScopes(req.Scopes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Scopes must be one or more of read, write and admin"})
+			return
+		}
+		for _, scope := range scopes {
+			if scope == auth.ScopeAdmin && c.GetString("role") != string(models.RoleAdmin) {
+				c.JSON(http.StatusForbidden, models.Error{Error: "Only admins can create keys with the admin scope"})
+				return
+			}
+		}
+
+		// Checked in days first, so that huge values cannot overflow the duration
+		lifetime := auth.DefaultAPIKeyLifetime
+		if req.ExpiresInDays != 0 {
+			if req.ExpiresInDays < 1 || req.ExpiresInDays > auth.MaxAPIKeyLifetimeDays {
+				c.JSON(http.StatusBadRequest, models.Error{Error: "expiresInDays must be between 1 and 365"})
+				return
+			}
+			lifetime = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+		}
+
+		key, apiKey, err := auth.CreateAPIKey(db, userID, name, scopes, time.Now().Add(lifetime))
+		if errors.Is(err, auth.ErrTooManyAPIKeys) {
+			c.JSON(http.StatusConflict, models.Error{Error: "Too many active API keys, revoke one first"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to create API key"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, models.CreateAPIKeyResponse{
+			Message: "API key created. Copy it now, it will not be shown again",
+			Key:     key,
+			APIKey:  apiKey,
+		})
+	}
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke an API key
+// @Description Revoke one of the current user's API keys. Requests with it fail from then on
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error
+// @Failure 401 {object} models.Error
+// @Failure 404 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /auth/api-keys/{id} [delete]
+func RevokeAPIKey(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		keyID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid API key ID"})
+			return
+		}
+
+		err = auth.RevokeAPIKey(db, userID, keyID)
+		if err == auth.ErrAPIKeyNotFound {
+			c.JSON(http.StatusNotFound, models.Error{Error: "API key not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to revoke API key"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "API key revoked"})
+	}
+}
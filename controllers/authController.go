@@ -3,10 +3,14 @@ package controllers
 import (
 	"database/sql"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"online-learning-golang/auth"
 	"online-learning-golang/models"
 	"online-learning-golang/utils"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,14 +19,17 @@ import (
 
 // Login godoc
 // @Summary Log in
-// @Description Log in using email or username and password
+// @Description Log in using email or username and password. Users with two-factor authentication get an MFA token to finish logging in at /auth/mfa/verify instead of access tokens
 // @Tags Authentication
 // @Accept json
 // @Produce json
 // @Param user body models.LoginRequest true "Login credentials"
 // @Success 200 {object} models.LoginResponse
+// @Success 200 {object} models.MFAChallengeResponse "Second factor required"
 // @Failure 400 {object} models.Error "Invalid request"
 // @Failure 401 {object} models.Error "Authentication failed"
+// @Failure 403 {object} models.Error "Email address not verified"
+// @Failure 429 {object} models.Error "Too many failed attempts"
 // @Failure 500 {object} models.Error "Server error"
 // @Router /auth/login [post]
 func Login(db *sql.DB) gin.HandlerFunc {
@@ -41,25 +48,32 @@ func Login(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		tx, err := db.Begin()
+		// The IP is only read here, and locked just long enough to count a
+		// failure, so that logins from a shared school or NAT address do not
+		// wait on each other
+		ipKey := auth.ThrottleKey(auth.LoginIPPolicy, "ip", c.ClientIP())
+		retryAfter, err := auth.ThrottleRetryAfter(db, auth.LoginIPPolicy, ipKey)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to begin transaction",
+				Error: "Failed to check request limits",
 			})
 			return
 		}
-		defer tx.Rollback()
+		if retryAfter > 0 {
+			tooManyAttempts(c, retryAfter)
+			return
+		}
 
 		var user models.UserDetail
 		var password string
 		query := `
 			SELECT id, email, username, fullName, password, 
-				   gender, avatar, dateOfBirth, role 
+				   gender, avatar, dateOfBirth, role, emailVerifiedAt IS NOT NULL 
 			FROM users 
 			WHERE (LOWER(email) = LOWER(?) OR LOWER(username) = LOWER(?)) 
 			AND deletedAt IS NULL`
 
-		err = tx.QueryRow(query, loginData.Identifier, loginData.Identifier).
+		err = db.QueryRow(query, loginData.Identifier, loginData.Identifier).
 			Scan(
 				&user.ID,
 				&user.Email,
@@ -70,65 +84,216 @@ func Login(db *sql.DB) gin.HandlerFunc {
 				&user.Avatar,
 				&user.DateOfBirth,
 				&user.Role,
+				&user.EmailVerified,
 			)
 
-		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(http.StatusUnauthorized, models.Error{
-					Error: "Invalid credentials",
-				})
-				return
-			}
+		found := err == nil
+		if err != nil && err != sql.ErrNoRows {
 			c.JSON(http.StatusInternalServerError, models.Error{
 				Error: "Failed to fetch user details",
 			})
 			return
 		}
 
-		// Verify password
-		if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(loginData.Password)); err != nil {
+		// Unknown identifiers are throttled like accounts, so the responses
+		// do not tell them apart
+		accountKey := auth.ThrottleKey(auth.LoginAccountPolicy, "identifier", loginData.Identifier)
+		if found {
+			accountKey = auth.UserThrottleKey(auth.LoginAccountPolicy, user.ID)
+		}
+		accountAttempt := beginThrottledAttempt(c, db, auth.LoginAccountPolicy, accountKey)
+		if accountAttempt == nil {
+			return
+		}
+		defer accountAttempt.Release()
 
+		// Verify password, against a dummy hash for unknown users so both take
+		// as long
+		if !found {
+			password = dummyPasswordHash
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(loginData.Password)); err != nil || !found {
+			recordLoginFailure(db, user, found, accountAttempt, ipKey)
 			c.JSON(http.StatusUnauthorized, models.Error{
 				Error: "Invalid credentials",
 			})
 			return
 		}
 
-		accessToken, expiresIn, err := utils.CreateAccessToken(user.ID, string(user.Role))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to generate access token",
+		if !user.EmailVerified && auth.VerificationRequiredForLogin() {
+			c.JSON(http.StatusForbidden, models.Error{
+				Error: "Email address has not been verified",
 			})
 			return
 		}
 
-		refreshToken, refreshExpiresIn, err := utils.CreateRefreshToken(user.ID, string(user.Role))
+		// The password was right, so this attempt is not counted
+		accountAttempt.Release()
+
+		continueLogin(c, db, user)
+	}
+}
+
+// Helper functions
+
+// dummyPasswordHash is compared against when no user matches the login.
+const dummyPasswordHash = "$2a$10$3q1Qcjx7zzpb3Vs42D6YbexPA4K9pKVA9pA2T8UIo0TjccGmet10m"
+
+// beginThrottledAttempt locks the key for one attempt, whose outcome the
+// caller then records. It answers 429 and returns nil if the key has to wait
+// first.
+func beginThrottledAttempt(c *gin.Context, db *sql.DB, policy auth.ThrottlePolicy, key string) *auth.ThrottledAttempt {
+	attempt, err := auth.BeginThrottledAttempt(db, policy, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Error{
+			Error: "Failed to check request limits",
+		})
+		return nil
+	}
+	if retryAfter := attempt.RetryAfter(); retryAfter > 0 {
+		attempt.Release()
+		tooManyAttempts(c, retryAfter)
+		return nil
+	}
+	return attempt
+}
+
+// throttled counts a request against the key, or answers 429 if the key has
+// to wait before its next one.
+func throttled(c *gin.Context, db *sql.DB, policy auth.ThrottlePolicy, key string) bool {
+	retryAfter, err := auth.ThrottleAttempt(db, policy, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Error{
+			Error: "Failed to check request limits",
+		})
+		return true
+	}
+	if retryAfter <= 0 {
+		return false
+	}
+
+	tooManyAttempts(c, retryAfter)
+	return true
+}
+
+func tooManyAttempts(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, models.Error{
+		Error: fmt.Sprintf("Too many attempts, please try again in %d seconds", seconds),
+	})
+}
+
+// recordLoginFailure counts a failed login against the account and the IP,
+// and emails an unlock link when it locks a real account.
+func recordLoginFailure(db *sql.DB, user models.UserDetail, found bool, accountAttempt *auth.ThrottledAttempt, ipKey string) {
+	locked, err := accountAttempt.Record()
+	if err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+	if _, err := auth.RecordThrottledFailure(db, auth.LoginIPPolicy, ipKey); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+	if !locked || !found {
+		return
+	}
+
+	token, err := auth.IssueAccountUnlock(db, user.ID)
+	if err != nil {
+		log.Printf("Error issuing unlock token for user %d: %v", user.ID, err)
+		return
+	}
+	// Sent in the background so the response takes no longer for real accounts
+	go func() {
+		if err := utils.SendUnlockEmail(user.Email, token); err != nil {
+			log.Printf("Error sending unlock email to user %d: %v", user.ID, err)
+		}
+	}()
+}
+
+// continueLogin moves a user who has proven who they are to the second
+// factor if they need one, or starts their session.
+func continueLogin(c *gin.Context, db *sql.DB, user models.UserDetail) {
+	mfaEnabled, err := auth.MFAEnabled(db, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Error{
+			Error: "Failed to check two-factor authentication",
+		})
+		return
+	}
+
+	if mfaEnabled {
+		mfaToken, expiresIn, err := utils.CreateToken(utils.TokenTypeMFA, user.ID, string(user.Role), "", mfaTokenTTL)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to generate refresh token",
+				Error: "Failed to generate MFA token",
 			})
 			return
 		}
 
-		if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusOK, models.MFAChallengeResponse{
+			Message:     "Two-factor authentication required",
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresIn:   expiresIn,
+		})
+		return
+	}
+
+	if auth.MFARequired(string(user.Role)) {
+		enrollmentToken, expiresIn, err := utils.CreateToken(utils.TokenTypeMFAEnrollment, user.ID, string(user.Role), "", mfaEnrollmentTokenTTL)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to complete login process",
+				Error: "Failed to generate MFA token",
 			})
 			return
 		}
 
-		setRefreshTokenCookie(c, refreshToken, int(refreshExpiresIn))
-
-		c.JSON(http.StatusOK, models.LoginResponse{
-			Message:     "Login successful",
-			User:        user,
-			AccessToken: accessToken,
-			ExpiresIn:   expiresIn,
+		c.JSON(http.StatusOK, models.MFAChallengeResponse{
+			Message:            "Two-factor authentication must be set up before logging in",
+			EnrollmentRequired: true,
+			MFAToken:           enrollmentToken,
+			ExpiresIn:          expiresIn,
 		})
+		return
 	}
+
+	completeLogin(c, db, user)
 }
 
-// Helper functions
+// completeLogin starts a session for a user who has passed every login step.
+// Only then are their failed password attempts forgotten, so a correct
+// password alone does not lift the lockout while the second factor is pending.
+func completeLogin(c *gin.Context, db *sql.DB, user models.UserDetail) {
+	if err := auth.ResetThrottle(db, auth.UserThrottleKey(auth.LoginAccountPolicy, user.ID)); err != nil {
+		log.Printf("Error resetting login throttle of user %d: %v", user.ID, err)
+	}
+
+	refreshToken, err := auth.IssueRefreshToken(db, user.ID, clientInfo(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Error{
+			Error: "Failed to generate refresh token",
+		})
+		return
+	}
+
+	accessToken, expiresIn, err := utils.CreateAccessToken(user.ID, string(user.Role), refreshToken.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.Error{
+			Error: "Failed to generate access token",
+		})
+		return
+	}
+
+	setRefreshTokenCookie(c, refreshToken.Token, int(refreshToken.ExpiresIn))
+
+	c.JSON(http.StatusOK, models.LoginResponse{
+		Message:     "Login successful",
+		User:        user,
+		AccessToken: accessToken,
+		ExpiresIn:   expiresIn,
+	})
+}
 
 func validateLoginInput(data models.LoginRequest) error {
 	if data.Identifier == "" {
@@ -140,6 +305,17 @@ func validateLoginInput(data models.LoginRequest) error {
 	return nil
 }
 
+func clientInfo(c *gin.Context) auth.ClientInfo {
+	return auth.ClientInfo{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+func clearRefreshTokenCookie(c *gin.Context) {
+	setRefreshTokenCookie(c, "", -1)
+}
+
 func setRefreshTokenCookie(c *gin.Context, token string, expiresIn int) {
 	c.SetCookie(
 		"refreshToken",
@@ -154,56 +330,63 @@ func setRefreshTokenCookie(c *gin.Context, token string, expiresIn int) {
 
 // RefreshToken godoc
 // @Summary Refresh access token
-// @Description Refresh both access token and refresh token
+// @Description Exchange the refresh token cookie for a new access token. The refresh token is rotated: the old one stops working, and presenting it again revokes the whole login.
 // @Tags Authentication
 // @Produce json
 // @Success 200 {object} models.AccessTokenResponse "Returns new access token and sets new refresh token cookie"
-// @Failure 400 {object} models.Error "Invalid user ID"
-// @Failure 401 {object} models.Error "Invalid or missing refresh token"
+// @Failure 401 {object} models.Error "Invalid, expired, revoked or reused refresh token"
 // @Failure 500 {object} models.Error "Server error"
 // @Router /auth/refresh-token [post]
-func RefreshToken() gin.HandlerFunc {
+func RefreshToken(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		refreshToken, err := c.Cookie("refreshToken")
-		if err != nil {
+		if err != nil || refreshToken == "" {
 			c.JSON(http.StatusUnauthorized, models.Error{
 				Error: "No refresh token found",
 			})
 			return
 		}
 
-		userId, role, err := utils.ValidToken(refreshToken)
-		if err != nil {
+		next, err := auth.RotateRefreshToken(db, refreshToken, clientInfo(c))
+		if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+			clearRefreshTokenCookie(c)
 			c.JSON(http.StatusUnauthorized, models.Error{
 				Error: "Invalid refresh token",
 			})
 			return
 		}
-
-		if userId <= 0 {
-			c.JSON(http.StatusBadRequest, models.Error{
-				Error: "Invalid user ID",
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to refresh token",
 			})
 			return
 		}
 
-		accessToken, expiresIn, err := utils.CreateAccessToken(userId, role)
+		var role string
+		err = db.QueryRow("SELECT role FROM users WHERE id = ? AND deletedAt IS NULL", next.UserID).Scan(&role)
+		if err == sql.ErrNoRows {
+			clearRefreshTokenCookie(c)
+			c.JSON(http.StatusUnauthorized, models.Error{
+				Error: "Invalid refresh token",
+			})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to generate access token",
+				Error: "Failed to fetch user details",
 			})
 			return
 		}
 
-		newRefreshToken, refreshExpiresIn, err := utils.CreateRefreshToken(userId, role)
+		accessToken, expiresIn, err := utils.CreateAccessToken(next.UserID, role, next.SessionID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to generate refresh token",
+				Error: "Failed to generate access token",
 			})
 			return
 		}
 
-		setRefreshTokenCookie(c, newRefreshToken, int(refreshExpiresIn))
+		setRefreshTokenCookie(c, next.Token, int(next.ExpiresIn))
 
 		c.JSON(http.StatusOK, models.AccessTokenResponse{
 			AccessToken: accessToken,
@@ -214,23 +397,24 @@ func RefreshToken() gin.HandlerFunc {
 
 // Logout godoc
 // @Summary Log out
-// @Description Log out by clearing the refresh token and invalidating the session
+// @Description Log out by revoking the refresh token and clearing its cookie
 // @Tags Authentication
 // @Produce json
 // @Success 200 {object} models.Message "Logout successful"
-// @Failure 401 {object} models.Error "No refresh token found"
+// @Failure 500 {object} models.Error "Server error"
 // @Router /auth/logout [post]
-func Logout() gin.HandlerFunc {
+func Logout(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.SetCookie(
-			"refreshToken",
-			"",
-			-1,
-			"/",
-			os.Getenv("COOKIE_DOMAIN"),
-			os.Getenv("ENV") == "production",
-			true,
-		)
+		if refreshToken, err := c.Cookie("refreshToken"); err == nil && refreshToken != "" {
+			if err := auth.RevokeRefreshToken(db, refreshToken); err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{
+					Error: "Failed to revoke refresh token",
+				})
+				return
+			}
+		}
+
+		clearRefreshTokenCookie(c)
 
 		c.JSON(http.StatusOK, models.Message{
 			Message: "Logout successful",
@@ -240,14 +424,14 @@ func Logout() gin.HandlerFunc {
 
 // ForgotPassword godoc
 // @Summary Request password reset
-// @Description Send a password reset link to the user's email
+// @Description Send a password reset link to the user's email. The response is the same whether or not an account uses the email
 // @Tags Authentication
 // @Accept json
 // @Produce json
 // @Param email body models.ForgotPasswordRequest true "User email"
 // @Success 200 {object} models.Message
 // @Failure 400 {object} models.Error
-// @Failure 404 {object} models.Error
+// @Failure 429 {object} models.Error "Too many requests"
 // @Failure 500 {object} models.Error "Server error"
 // @Router /auth/forgot-password [post]
 func ForgotPassword(db *sql.DB) gin.HandlerFunc {
@@ -267,6 +451,17 @@ func ForgotPassword(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		ipKey := auth.ThrottleKey(auth.ForgotPasswordIPPolicy, "ip", c.ClientIP())
+		emailKey := auth.ThrottleKey(auth.ForgotPasswordEmailPolicy, "email", req.Email)
+		if throttled(c, db, auth.ForgotPasswordIPPolicy, ipKey) || throttled(c, db, auth.ForgotPasswordEmailPolicy, emailKey) {
+			return
+		}
+
+		// Whether the email belongs to an account must not show in the response
+		sent := models.Message{
+			Message: "If an account uses this email, password reset instructions have been sent to it",
+		}
+
 		tx, err := db.Begin()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
@@ -280,14 +475,12 @@ func ForgotPassword(db *sql.DB) gin.HandlerFunc {
 		err = tx.QueryRow(`
 			SELECT id, email 
 			FROM users 
-			WHERE email = ? AND deletedAt IS NULL
+			WHERE LOWER(email) = LOWER(?) AND deletedAt IS NULL
 		`, req.Email).Scan(&user.ID, &user.Email)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
-				c.JSON(http.StatusNotFound, models.Error{
-					Error: "Email not found",
-				})
+				c.JSON(http.StatusOK, sent)
 				return
 			}
 			c.JSON(http.StatusInternalServerError, models.Error{
@@ -324,14 +517,6 @@ func ForgotPassword(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		err = utils.SendResetEmail(req.Email, token)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, models.Error{
-				Error: "Failed to send reset email",
-			})
-			return
-		}
-
 		if err = tx.Commit(); err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
 				Error: "Failed to complete password reset request",
@@ -339,15 +524,20 @@ func ForgotPassword(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, models.Message{
-			Message: "Password reset instructions sent to your email",
-		})
+		// Sent in the background so the response takes no longer for real accounts
+		go func() {
+			if err := utils.SendResetEmail(user.Email, token); err != nil {
+				log.Printf("Error sending password reset email to user %d: %v", user.ID, err)
+			}
+		}()
+
+		c.JSON(http.StatusOK, sent)
 	}
 }
 
 // ResetPassword godoc
 // @Summary Reset user password
-// @Description Reset the user's password using a valid token
+// @Description Reset the user's password using a valid token. Signs the user out everywhere and revokes their API keys
 // @Tags Authentication
 // @Accept json
 // @Produce json
@@ -431,8 +621,7 @@ func ResetPassword(db *sql.DB) gin.HandlerFunc {
 
 		_, err = tx.Exec(`
 			UPDATE users 
-			SET password = ?,
-				updatedAt = NOW()
+			SET password = ?
 			WHERE id = ?
 		`, hashedPassword, userId)
 		if err != nil {
@@ -450,6 +639,27 @@ func ResetPassword(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Whoever knew the old password may still hold a session
+		if err := auth.RevokeUserSessions(tx, userId); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to revoke sessions",
+			})
+			return
+		}
+		if err := auth.RevokeUserAPIKeys(tx, userId); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to revoke API keys",
+			})
+			return
+		}
+
+		if err := auth.ResetThrottle(tx, auth.UserThrottleKey(auth.LoginAccountPolicy, userId)); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to unlock account",
+			})
+			return
+		}
+
 		if err = tx.Commit(); err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
 				Error: "Failed to complete password reset",
@@ -462,3 +672,455 @@ func ResetPassword(db *sql.DB) gin.HandlerFunc {
 		})
 	}
 }
+
+// RequestMagicLink godoc
+// @Summary Request a login link
+// @Description Email a single-use link that logs the user in without a password. The response is the same whether or not an account uses the email
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param email body models.MagicLinkRequest true "User email"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error
+// @Failure 429 {object} models.Error "Too many requests"
+// @Failure 500 {object} models.Error "Server error"
+// @Router /auth/magic-link [post]
+func RequestMagicLink(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.MagicLinkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Invalid request format",
+			})
+			return
+		}
+
+		if req.Email == "" || !utils.IsValidEmail(req.Email) {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Valid email is required",
+			})
+			return
+		}
+
+		ipKey := auth.ThrottleKey(auth.MagicLinkIPPolicy, "ip", c.ClientIP())
+		emailKey := auth.ThrottleKey(auth.MagicLinkEmailPolicy, "email", req.Email)
+		if throttled(c, db, auth.MagicLinkIPPolicy, ipKey) || throttled(c, db, auth.MagicLinkEmailPolicy, emailKey) {
+			return
+		}
+
+		// Whether the email belongs to an account must not show in the response
+		sent := models.Message{
+			Message: "If an account uses this email, a login link has been sent to it",
+		}
+
+		var user models.UserDetail
+		err := db.QueryRow(`
+			SELECT id, email
+			FROM users
+			WHERE LOWER(email) = LOWER(?) AND deletedAt IS NULL
+		`, req.Email).Scan(&user.ID, &user.Email)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusOK, sent)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to query user",
+			})
+			return
+		}
+
+		token, err := auth.IssueMagicLink(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to generate login link",
+			})
+			return
+		}
+
+		// Sent in the background so the response takes no longer for real accounts
+		go func() {
+			if err := utils.SendMagicLinkEmail(user.Email, token); err != nil {
+				log.Printf("Error sending login link to user %d: %v", user.ID, err)
+			}
+		}()
+
+		c.JSON(http.StatusOK, sent)
+	}
+}
+
+// MagicLinkLogin godoc
+// @Summary Log in with a login link
+// @Description Exchange the token from a login link email for access tokens. Each link works once. Users with two-factor authentication get an MFA token to finish logging in at /auth/mfa/verify
+// @Tags Authentication
+// @Produce json
+// @Param token query string true "Login link token"
+// @Success 200 {object} models.LoginResponse
+// @Success 200 {object} models.MFAChallengeResponse "Second factor required"
+// @Failure 400 {object} models.Error "Missing token"
+// @Failure 401 {object} models.Error "Invalid or expired token"
+// @Failure 500 {object} models.Error "Server error"
+// @Router /auth/magic-link/login [post]
+func MagicLinkLogin(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Token is required",
+			})
+			return
+		}
+
+		userID, err := auth.RedeemMagicLink(db, token)
+		if err == auth.ErrInvalidMagicLink {
+			c.JSON(http.StatusUnauthorized, models.Error{
+				Error: "Invalid or expired login link",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to check login link",
+			})
+			return
+		}
+
+		user, err := GetUserDetail(db, strconv.Itoa(userID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to fetch user details",
+			})
+			return
+		}
+
+		continueLogin(c, db, user)
+	}
+}
+
+// UnlockAccount godoc
+// @Summary Unlock account
+// @Description Lift the login lockout of an account using the token from the lockout email
+// @Tags Authentication
+// @Produce json
+// @Param token query string true "Unlock token"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error "Missing token"
+// @Failure 401 {object} models.Error "Invalid or expired token"
+// @Failure 500 {object} models.Error "Server error"
+// @Router /auth/unlock-account [post]
+func UnlockAccount(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Token is required",
+			})
+			return
+		}
+
+		err := auth.UnlockAccount(db, token)
+		if err == auth.ErrInvalidUnlockToken {
+			c.JSON(http.StatusUnauthorized, models.Error{
+				Error: "Invalid or expired token",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to unlock account",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{
+			Message: "Account unlocked successfully",
+		})
+	}
+}
+
+// VerifyEmail godoc
+// @Summary Verify email address
+// @Description Verify the user's email address using the token from the verification email
+// @Tags Authentication
+// @Produce json
+// @Param token query string true "Verification token"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error "Missing token"
+// @Failure 401 {object} models.Error "Invalid or expired token"
+// @Failure 500 {object} models.Error "Server error"
+// @Router /auth/verify-email [post]
+func VerifyEmail(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Token is required",
+			})
+			return
+		}
+
+		err := auth.VerifyEmail(db, token)
+		if err == auth.ErrInvalidVerificationToken {
+			c.JSON(http.StatusUnauthorized, models.Error{
+				Error: "Invalid or expired token",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to verify email",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{
+			Message: "Email verified successfully",
+		})
+	}
+}
+
+// ResendVerificationEmail godoc
+// @Summary Resend verification email
+// @Description Send a new email verification link. The response is the same whether or not an unverified account uses the email. Limited to one per minute and five per hour per account
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param email body models.ResendVerificationRequest true "User's email"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error "Invalid email"
+// @Failure 429 {object} models.Error "Too many requests"
+// @Failure 500 {object} models.Error "Server error"
+// @Router /auth/resend-verification [post]
+func ResendVerificationEmail(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.ResendVerificationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Invalid request format",
+			})
+			return
+		}
+
+		if !utils.IsValidEmail(req.Email) {
+			c.JSON(http.StatusBadRequest, models.Error{
+				Error: "Invalid email format",
+			})
+			return
+		}
+
+		ipKey := auth.ThrottleKey(auth.VerificationIPPolicy, "ip", c.ClientIP())
+		emailKey := auth.ThrottleKey(auth.VerificationEmailPolicy, "email", req.Email)
+		if throttled(c, db, auth.VerificationIPPolicy, ipKey) || throttled(c, db, auth.VerificationEmailPolicy, emailKey) {
+			return
+		}
+
+		// Whether the email belongs to an account, or one that is verified
+		// already, must not show in the response
+		sent := models.Message{
+			Message: "If an unverified account uses this email, a verification link has been sent to it",
+		}
+
+		token, err := auth.ResendEmailVerification(db, req.Email)
+		switch {
+		case err == sql.ErrNoRows, err == auth.ErrEmailAlreadyVerified, err == auth.ErrVerificationThrottled:
+			c.JSON(http.StatusOK, sent)
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to generate verification token",
+			})
+			return
+		}
+
+		// Sent in the background so the response takes no longer for real accounts
+		go func() {
+			if err := utils.SendVerificationEmail(req.Email, token); err != nil {
+				log.Printf("Error sending verification email: %v", err)
+			}
+		}()
+
+		c.JSON(http.StatusOK, sent)
+	}
+}
+
+// GetSessions godoc
+// @Summary List active sessions
+// @Description List the devices the current user is signed in on
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} auth.Session
+// @Failure 401 {object} models.Error
+// @Failure 403 {object} models.Error "Not allowed with an API key"
+// @Failure 500 {object} models.Error
+// @Router /auth/sessions [get]
+func GetSessions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		sessions, err := auth.GetSessions(db, userID, c.GetString("sessionId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to fetch sessions"})
+			return
+		}
+
+		c.JSON(http.StatusOK, sessions)
+	}
+}
+
+// RevokeSession godoc
+// @Summary Revoke a session
+// @Description Sign the current user out of one device
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Session ID"
+// @Success 200 {object} models.Message
+// @Failure 401 {object} models.Error
+// @Failure 403 {object} models.Error "Not allowed with an API key"
+// @Failure 404 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /auth/sessions/{id} [delete]
+func RevokeSession(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		sessionID := c.Param("id")
+		revoked, err := auth.RevokeSession(db, userID, sessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to revoke session"})
+			return
+		}
+		if !revoked {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Session not found"})
+			return
+		}
+
+		if sessionID == c.GetString("sessionId") {
+			clearRefreshTokenCookie(c)
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "Session revoked"})
+	}
+}
+
+// RevokeAllSessions godoc
+// @Summary Revoke all sessions
+// @Description Sign the current user out of every device, including this one
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} models.Message
+// @Failure 401 {object} models.Error
+// @Failure 403 {object} models.Error "Not allowed with an API key"
+// @Failure 500 {object} models.Error
+// @Router /auth/sessions [delete]
+func RevokeAllSessions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		if err := auth.RevokeUserSessions(db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to revoke sessions"})
+			return
+		}
+
+		clearRefreshTokenCookie(c)
+
+		c.JSON(http.StatusOK, models.Message{Message: "All sessions revoked"})
+	}
+}
+
+// GetUserSessions godoc
+// @Summary List a user's sessions
+// @Description List the devices a user is signed in on (admin only)
+// @Tags User
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {array} auth.Session
+// @Failure 400 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /users/{id}/sessions [get]
+func GetUserSessions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		sessions, err := auth.GetSessions(db, userID, c.GetString("sessionId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to fetch sessions"})
+			return
+		}
+
+		c.JSON(http.StatusOK, sessions)
+	}
+}
+
+// SignOutUser godoc
+// @Summary Force sign-out
+// @Description Revoke every session and API key of a user, signing them out on all devices and cutting off their scripts (admin only)
+// @Tags User
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /users/{id}/sessions [delete]
+func SignOutUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		if err := auth.RevokeUserSessions(db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to revoke sessions"})
+			return
+		}
+		// A compromised account must not stay usable through its keys
+		if err := auth.RevokeUserAPIKeys(db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to revoke API keys"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "User signed out of all sessions and API keys revoked"})
+	}
+}
+
+// GetJWKS godoc
+// @Summary Get token signing keys
+// @Description Get the public keys access tokens are signed with, as a JSON Web Key Set. Other services use it to verify tokens locally, picking the key by the token's kid header.
+// @Tags Authentication
+// @Produce json
+// @Success 200 {object} models.JWKSet
+// @Failure 500 {object} models.Error
+// @Router /.well-known/jwks.json [get]
+func GetJWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jwks, err := utils.JWKS()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to load signing keys"})
+			return
+		}
+
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, jwks)
+	}
+}
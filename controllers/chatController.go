@@ -2,11 +2,22 @@ package controllers
 
 import (
 	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"log"
 	"net/http"
 	"online-learning-golang/chat"
 	"online-learning-golang/models"
+	"online-learning-golang/utils"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -15,9 +26,66 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
+	CheckOrigin:     isAllowedOrigin,
+}
+
+const chatTicketTTL = 30 * time.Second
+
+// isAllowedOrigin accepts the same front-end origins as the CORS config, plus
+// any listed in CHAT_ALLOWED_ORIGINS. Non-browser clients send no Origin.
+func isAllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
 		return true
-	},
+	}
+
+	allowed := []string{"http://localhost:3000", "http://localhost:8080", os.Getenv("CLIENT_URL")}
+	allowed = append(allowed, strings.Split(os.Getenv("CHAT_ALLOWED_ORIGINS"), ",")...)
+	for _, o := range allowed {
+		if o = strings.TrimSpace(o); o != "" && strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// @Summary      Create WebSocket Ticket
+// @Description  Tạo ticket dùng một lần để xác thực kết nối WebSocket
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  models.ChatTicketResponse
+// @Failure      401  {object}  models.Error
+// @Failure      500  {object}  models.Error
+// @Router       /chat/ticket [post]
+func CreateChatTicket(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		ticket, err := utils.GenerateResetToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to generate ticket"})
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO chat_tickets (token, userId, sessionId, expiry)
+			VALUES (?, ?, ?, ?)
+		`, ticket, userID, c.GetString("sessionId"), time.Now().Add(chatTicketTTL))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to store ticket"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.ChatTicketResponse{
+			Ticket:    ticket,
+			ExpiresIn: int64(chatTicketTTL.Seconds()),
+		})
+	}
 }
 
 // @Summary      WebSocket Chat Connection
@@ -25,16 +93,26 @@ var upgrader = websocket.Upgrader{
 // @Tags         chat
 // @Accept       json
 // @Produce      json
-// @Security     Bearer
+// @Security     BearerAuth
+// @Param        ticket  query     string  false  "Ticket lấy từ /chat/ticket"
 // @Success      101  {string}  string    "Switching Protocols to WebSocket"
 // @Failure      400  {object}  models.Error
 // @Failure      401  {object}  models.Error
 // @Router       /ws [get]
 func HandleWebSocket(manager *chat.Manager) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.GetInt("userId")
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		var responseHeader http.Header
+		if protocol := c.GetString("wsProtocol"); protocol != "" {
+			responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+		}
 
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 		if err != nil {
 			log.Printf("Failed to upgrade connection: %v", err)
 			return
@@ -43,64 +121,763 @@ func HandleWebSocket(manager *chat.Manager) gin.HandlerFunc {
 		client := &chat.Client{
 			ID:     conn.RemoteAddr().String(),
 			UserID: userID,
+			Role:   c.GetString("role"),
 			Conn:   conn,
-			Send:   make(chan []byte, 256),
+			Send:   make(chan []byte, manager.Config.SendBufferSize),
+			Rooms:  make(map[string]bool),
 		}
 
 		manager.Register <- client
 
-		go client.WritePump()
+		go client.WritePump(manager)
 		go client.ReadPump(manager)
 	}
 }
 
+// @Summary      Upload Chat Attachment
+// @Description  Tải lên ảnh (JPEG, PNG, GIF, tối đa 5MB) hoặc PDF (tối đa 10MB) để đính kèm vào tin nhắn
+// @Tags         chat
+// @Accept       multipart/form-data
+// @Produce      json
+// @Security     BearerAuth
+// @Param        file  formData  file  true  "Tệp đính kèm"
+// @Success      201   {object}  chat.Attachment
+// @Failure      400   {object}  models.Error
+// @Failure      401   {object}  models.Error
+// @Failure      500   {object}  models.Error
+// @Router       /chat/attachments [post]
+func UploadChatAttachment(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		file, fileHeader, err := c.Request.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "No file provided or invalid file"})
+			return
+		}
+		defer file.Close()
+
+		// Trust the file content rather than the client's Content-Type
+		head := make([]byte, 512)
+		n, _ := file.Read(head)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to process uploaded file"})
+			return
+		}
+
+		attachment := chat.Attachment{
+			FileName: attachmentFileName(fileHeader.Filename),
+			MimeType: http.DetectContentType(head[:n]),
+			Size:     fileHeader.Size,
+		}
+
+		switch {
+		case utils.IsValidImageType(attachment.MimeType):
+			if attachment.Size > chat.MaxImageSize {
+				c.JSON(http.StatusBadRequest, models.Error{Error: "File size exceeds maximum limit of 5MB"})
+				return
+			}
+
+			config, _, err := image.DecodeConfig(file)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid image file"})
+				return
+			}
+			attachment.Width, attachment.Height = config.Width, config.Height
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to process uploaded file"})
+				return
+			}
+
+			cld, err := utils.SetupCloudinary()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to initialize upload service"})
+				return
+			}
+			attachment.URL, err = utils.UploadImage(cld, file)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to upload file"})
+				return
+			}
+
+		case attachment.MimeType == chat.AttachmentMimePDF:
+			if attachment.Size > chat.MaxDocumentSize {
+				c.JSON(http.StatusBadRequest, models.Error{Error: "File size exceeds maximum limit of 10MB"})
+				return
+			}
+
+			// UploadPDF stores files under their name, so give each upload its own
+			key, err := utils.GenerateResetToken()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to process uploaded file"})
+				return
+			}
+			fileHeader.Filename = "chat-" + key + ".pdf"
+
+			attachment.URL, err = utils.UploadPDF(file, fileHeader)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to upload file"})
+				return
+			}
+
+		default:
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid file type. Only JPEG, PNG, GIF and PDF are allowed"})
+			return
+		}
+
+		if err := chat.CreateAttachment(db, userID, &attachment); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, attachment)
+	}
+}
+
+func attachmentFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[:255])
+	}
+	return name
+}
+
+// @Summary      Get Chat Rooms
+// @Description  Lấy danh sách phòng chat mà người dùng có thể tham gia
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   chat.Room
+// @Failure      401  {object}  models.Error
+// @Failure      500  {object}  models.Error
+// @Router       /chat/rooms [get]
+func GetChatRooms(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		rooms, err := chat.GetRooms(db, userID, c.GetString("role"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, rooms)
+	}
+}
+
 // @Summary      Get Chat History
-// @Description  Lấy lịch sử chat với phân trang
+// @Description  Lấy lịch sử chat của một phòng, phân trang theo ID tin nhắn
 // @Tags         chat
 // @Accept       json
 // @Produce      json
-// @Param        limit   query     int  false  "Số lượng tin nhắn mỗi trang"  default(50)
-// @Param        offset  query     int  false  "Vị trí bắt đầu"               default(0)
+// @Security     BearerAuth
+// @Param        room    query     string  false  "Phòng chat (lobby, course:{id}, class:{id}, subject:{id}, dm:{id}:{id})"  default(lobby)
+// @Param        before  query     int     false  "Chỉ lấy tin nhắn cũ hơn ID này"
+// @Param        after   query     int     false  "Chỉ lấy tin nhắn mới hơn ID này"
+// @Param        limit   query     int     false  "Số lượng tin nhắn mỗi trang"  default(50)
 // @Success      200    {array}    chat.Message
+// @Failure      400    {object}   models.Error
+// @Failure      403    {object}   models.Error
 // @Failure      500    {object}   models.Error
 // @Router       /history [get]
 func GetChatHistory(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		limit := 50
-		offset := 0
+		room := c.DefaultQuery("room", chat.LobbyRoom)
+		if status, err := checkRoomAccess(c, db, room); err != nil {
+			c.JSON(status, models.Error{Error: err.Error()})
+			return
+		}
 
-		if limitStr := c.Query("limit"); limitStr != "" {
-			limit, _ = strconv.Atoi(limitStr)
+		before, after, limit := parseCursor(c)
+		messages, err := chat.GetMessages(db, room, before, after, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
 		}
-		if offsetStr := c.Query("offset"); offsetStr != "" {
-			offset, _ = strconv.Atoi(offsetStr)
+
+		c.JSON(http.StatusOK, messages)
+	}
+}
+
+// @Summary      Search Chat Messages
+// @Description  Tìm kiếm tin nhắn trong một phòng theo nội dung, người gửi và khoảng thời gian
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        room      query     string  false  "Phòng chat"  default(lobby)
+// @Param        q         query     string  false  "Từ khoá"
+// @Param        senderId  query     int     false  "ID người gửi"
+// @Param        from      query     string  false  "Từ ngày (YYYY-MM-DD hoặc RFC3339)"
+// @Param        to        query     string  false  "Đến ngày (YYYY-MM-DD hoặc RFC3339)"
+// @Param        before    query     int     false  "Chỉ lấy tin nhắn cũ hơn ID này"
+// @Param        limit     query     int     false  "Số lượng kết quả"  default(50)
+// @Success      200       {array}   chat.Message
+// @Failure      400       {object}  models.Error
+// @Failure      403       {object}  models.Error
+// @Failure      500       {object}  models.Error
+// @Router       /chat/search [get]
+func SearchChatMessages(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := c.DefaultQuery("room", chat.LobbyRoom)
+		if status, err := checkRoomAccess(c, db, room); err != nil {
+			c.JSON(status, models.Error{Error: err.Error()})
+			return
 		}
 
-		query := `
-			SELECT id, content, senderId, createdAt 
-			FROM chat_messages 
-			ORDER BY createdAt DESC 
-			LIMIT ? OFFSET ?
-		`
+		before, _, limit := parseCursor(c)
+		query := chat.SearchQuery{
+			Room:   room,
+			Text:   strings.TrimSpace(c.Query("q")),
+			Before: before,
+			Limit:  limit,
+		}
 
-		rows, err := db.Query(query, limit, offset)
+		if senderIDStr := c.Query("senderId"); senderIDStr != "" {
+			senderID, err := strconv.Atoi(senderIDStr)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid senderId"})
+				return
+			}
+			query.SenderID = senderID
+		}
+
+		var err error
+		if query.From, err = parseDateParam(c.Query("from"), false); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid from date"})
+			return
+		}
+		if query.To, err = parseDateParam(c.Query("to"), true); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid to date"})
+			return
+		}
+
+		messages, err := chat.SearchMessages(db, query)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
 			return
 		}
-		defer rows.Close()
 
-		var messages []chat.Message
-		for rows.Next() {
-			var msg chat.Message
-			err := rows.Scan(&msg.ID, &msg.Content, &msg.SenderID, &msg.Timestamp)
-			if err != nil {
+		c.JSON(http.StatusOK, messages)
+	}
+}
+
+// @Summary      Get Message Context
+// @Description  Lấy các tin nhắn xung quanh một tin nhắn (nhảy đến tin nhắn)
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id     path      int  true   "ID tin nhắn"
+// @Param        limit  query     int  false  "Số tin nhắn mỗi phía"  default(10)
+// @Success      200    {array}   chat.Message
+// @Failure      400    {object}  models.Error
+// @Failure      403    {object}  models.Error
+// @Failure      404    {object}  models.Error
+// @Failure      500    {object}  models.Error
+// @Router       /chat/messages/{id}/context [get]
+func GetChatMessageContext(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		messageID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || messageID < 1 {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid message ID"})
+			return
+		}
+
+		room, err := chat.MessageRoom(db, messageID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Message not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		if status, err := checkRoomAccess(c, db, room); err != nil {
+			c.JSON(status, models.Error{Error: err.Error()})
+			return
+		}
+
+		size := utils.ClampInt(utils.ParseIntWithDefault(c.Query("limit"), 10), 1, 50)
+		messages, err := chat.GetMessageContext(db, room, messageID, size)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, messages)
+	}
+}
+
+// @Summary      Get Chat Thread
+// @Description  Lấy tin nhắn gốc và các câu trả lời trong luồng của một tin nhắn
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id     path      int  true   "ID tin nhắn"
+// @Param        after  query     int  false  "Chỉ lấy câu trả lời mới hơn ID này"
+// @Param        limit  query     int  false  "Số lượng câu trả lời"  default(50)
+// @Success      200    {object}  chat.Thread
+// @Failure      400    {object}  models.Error
+// @Failure      403    {object}  models.Error
+// @Failure      404    {object}  models.Error
+// @Failure      500    {object}  models.Error
+// @Router       /chat/messages/{id}/thread [get]
+func GetChatThread(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		messageID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || messageID < 1 {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid message ID"})
+			return
+		}
+
+		room, err := chat.MessageRoom(db, messageID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Message not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		if status, err := checkRoomAccess(c, db, room); err != nil {
+			c.JSON(status, models.Error{Error: err.Error()})
+			return
+		}
+
+		_, after, limit := parseCursor(c)
+		thread, err := chat.GetThread(db, messageID, after, limit)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Message not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, thread)
+	}
+}
+
+// @Summary      Get Online Users
+// @Description  Lấy danh sách người dùng đang trực tuyến trong một phòng chat
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        room  query     string  false  "Phòng chat"  default(lobby)
+// @Success      200   {array}   chat.UserSummary
+// @Failure      400   {object}  models.Error
+// @Failure      403   {object}  models.Error
+// @Failure      500   {object}  models.Error
+// @Router       /chat/online [get]
+func GetOnlineUsers(db *sql.DB, manager *chat.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := c.DefaultQuery("room", chat.LobbyRoom)
+		if status, err := checkRoomAccess(c, db, room); err != nil {
+			c.JSON(status, models.Error{Error: err.Error()})
+			return
+		}
+
+		users, err := chat.GetUserSummaries(db, manager.OnlineUsers(room))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, users)
+	}
+}
+
+// @Summary      Get Read States
+// @Description  Lấy vị trí đã đọc của các thành viên trong một phòng chat
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        room  query     string  false  "Phòng chat"  default(lobby)
+// @Success      200   {array}   chat.ReadState
+// @Failure      400   {object}  models.Error
+// @Failure      403   {object}  models.Error
+// @Failure      500   {object}  models.Error
+// @Router       /chat/read-states [get]
+func GetReadStates(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := c.DefaultQuery("room", chat.LobbyRoom)
+		if status, err := checkRoomAccess(c, db, room); err != nil {
+			c.JSON(status, models.Error{Error: err.Error()})
+			return
+		}
+
+		states, err := chat.GetReadStates(db, room)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, states)
+	}
+}
+
+// @Summary      Get Direct Conversations
+// @Description  Lấy danh sách cuộc trò chuyện riêng kèm tin nhắn cuối và số tin chưa đọc
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   chat.Conversation
+// @Failure      401  {object}  models.Error
+// @Failure      500  {object}  models.Error
+// @Router       /chat/conversations [get]
+func GetConversations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		conversations, err := chat.GetConversations(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, conversations)
+	}
+}
+
+// @Summary      Get Direct Conversation History
+// @Description  Lấy lịch sử trò chuyện riêng với một người dùng và đánh dấu đã đọc
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        userId  path      int  true   "ID người dùng còn lại"
+// @Param        before  query     int  false  "Chỉ lấy tin nhắn cũ hơn ID này"
+// @Param        after   query     int  false  "Chỉ lấy tin nhắn mới hơn ID này"
+// @Param        limit   query     int  false  "Số lượng tin nhắn mỗi trang"  default(50)
+// @Success      200     {array}   chat.Message
+// @Failure      400     {object}  models.Error
+// @Failure      404     {object}  models.Error
+// @Failure      500     {object}  models.Error
+// @Router       /chat/conversations/{userId}/messages [get]
+func GetConversationMessages(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		otherUserID, err := strconv.Atoi(c.Param("userId"))
+		if err != nil || otherUserID < 1 || otherUserID == userID {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		exists, err := chat.UserExists(db, otherUserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, models.Error{Error: "User not found"})
+			return
+		}
+
+		before, after, limit := parseCursor(c)
+		room := chat.DirectRoom(userID, otherUserID)
+		messages, err := chat.GetMessages(db, room, before, after, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		// Only the newest page means the user has caught up
+		if before == 0 && len(messages) > 0 {
+			if err := chat.MarkRead(db, userID, room, messages[0].ID); err != nil {
 				c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
 				return
 			}
-			messages = append(messages, msg)
 		}
 
 		c.JSON(http.StatusOK, messages)
 	}
 }
+
+// @Summary      Export Chat Transcript
+// @Description  Xuất lịch sử chat của một phòng trong khoảng thời gian dưới dạng JSON, CSV hoặc HTML (chỉ admin)
+// @Tags         chat
+// @Produce      json
+// @Produce      text/csv
+// @Produce      text/html
+// @Security     BearerAuth
+// @Param        room    query     string  true   "Phòng chat (lobby, course:{id}, class:{id}, subject:{id})"
+// @Param        from    query     string  false  "Từ ngày (YYYY-MM-DD hoặc RFC3339)"
+// @Param        to      query     string  false  "Đến ngày (YYYY-MM-DD hoặc RFC3339)"
+// @Param        format  query     string  false  "Định dạng"  Enums(json, csv, html)  default(json)
+// @Success      200     {object}  chat.Transcript
+// @Failure      400     {object}  models.Error
+// @Failure      500     {object}  models.Error
+// @Router       /chat/export [get]
+func ExportChatTranscript(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := c.Query("room")
+		if _, _, err := chat.ParseRoom(room); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid room"})
+			return
+		}
+
+		from, err := parseDateParam(c.Query("from"), false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid from date"})
+			return
+		}
+		to, err := parseDateParam(c.Query("to"), true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid to date"})
+			return
+		}
+
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "csv" && format != "html" {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid format. Use json, csv or html"})
+			return
+		}
+
+		transcript, err := chat.GetTranscript(db, room, from, to)
+		if err == chat.ErrTranscriptTooLarge {
+			c.JSON(http.StatusBadRequest, models.Error{Error: err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		fileName := fmt.Sprintf("chat-%s-%s.%s", strings.ReplaceAll(room, ":", "-"), time.Now().UTC().Format("20060102"), format)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+		switch format {
+		case "csv":
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			err = chat.WriteTranscriptCSV(c.Writer, transcript)
+		case "html":
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			err = chat.WriteTranscriptHTML(c.Writer, transcript)
+		default:
+			c.JSON(http.StatusOK, transcript)
+		}
+		if err != nil {
+			log.Printf("error: failed to write chat transcript: %v", err)
+		}
+	}
+}
+
+// @Summary      Get Room Sanctions
+// @Description  Lấy danh sách người dùng đang bị cấm chat hoặc cấm vào phòng
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        room  query     string  false  "Phòng chat"  default(lobby)
+// @Success      200   {array}   chat.Sanction
+// @Failure      400   {object}  models.Error
+// @Failure      500   {object}  models.Error
+// @Router       /chat/sanctions [get]
+func GetChatSanctions(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := c.DefaultQuery("room", chat.LobbyRoom)
+		if _, _, err := chat.ParseRoom(room); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: err.Error()})
+			return
+		}
+
+		sanctions, err := chat.GetSanctions(db, room)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, sanctions)
+	}
+}
+
+// @Summary      Mute or Ban User
+// @Description  Cấm chat (mute) hoặc cấm vào phòng (ban) một người dùng trong một khoảng thời gian
+// @Tags         chat
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        sanction  body      models.CreateSanctionRequest  true  "Thông tin xử phạt"
+// @Success      200       {object}  chat.Sanction
+// @Failure      400       {object}  models.Error
+// @Failure      404       {object}  models.Error
+// @Failure      500       {object}  models.Error
+// @Router       /chat/sanctions [post]
+func CreateChatSanction(db *sql.DB, manager *chat.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		var req models.CreateSanctionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid request body"})
+			return
+		}
+
+		if _, _, err := chat.ParseRoom(req.Room); err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: err.Error()})
+			return
+		}
+		if req.Type != chat.SanctionMute && req.Type != chat.SanctionBan {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Type must be mute or ban"})
+			return
+		}
+		if req.DurationMinutes < 1 {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Duration must be at least 1 minute"})
+			return
+		}
+		if req.UserID == adminID {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Cannot sanction yourself"})
+			return
+		}
+
+		exists, err := chat.UserExists(db, req.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, models.Error{Error: "User not found"})
+			return
+		}
+
+		sanction := chat.Sanction{
+			Room:      req.Room,
+			UserID:    req.UserID,
+			Type:      req.Type,
+			Reason:    req.Reason,
+			CreatedBy: adminID,
+		}
+		if err := chat.CreateSanction(db, &sanction, time.Duration(req.DurationMinutes)*time.Minute); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+
+		if sanction.Type == chat.SanctionBan && sanction.Room != chat.LobbyRoom {
+			manager.PublishEviction(chat.Eviction{UserID: sanction.UserID, Room: sanction.Room})
+		}
+
+		c.JSON(http.StatusOK, sanction)
+	}
+}
+
+// @Summary      Lift Sanction
+// @Description  Gỡ bỏ lệnh cấm trước thời hạn
+// @Tags         chat
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      int  true  "ID lệnh cấm"
+// @Success      200  {object}  models.Message
+// @Failure      400  {object}  models.Error
+// @Failure      404  {object}  models.Error
+// @Failure      500  {object}  models.Error
+// @Router       /chat/sanctions/{id} [delete]
+func LiftChatSanction(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid sanction ID"})
+			return
+		}
+
+		lifted, err := chat.LiftSanction(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: err.Error()})
+			return
+		}
+		if !lifted {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Sanction not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "Sanction lifted successfully"})
+	}
+}
+
+func parseCursor(c *gin.Context) (int, int, int) {
+	before, _ := strconv.Atoi(c.Query("before"))
+	after, _ := strconv.Atoi(c.Query("after"))
+	limit := utils.ClampInt(utils.ParseIntWithDefault(c.Query("limit"), 50), 1, 100)
+	return before, after, limit
+}
+
+// parseDateParam accepts RFC3339 timestamps or plain dates. A plain date used
+// as an upper bound includes that whole day.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func checkRoomAccess(c *gin.Context, db *sql.DB, room string) (int, error) {
+	userID, err := strconv.Atoi(c.GetString("userId"))
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid user ID")
+	}
+
+	if chat.IsDirectRoom(room) {
+		userOneID, userTwoID, err := chat.ParseDirectRoom(room)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if userID != userOneID && userID != userTwoID {
+			return http.StatusForbidden, fmt.Errorf("access to room denied")
+		}
+		return http.StatusOK, nil
+	}
+
+	if _, _, err := chat.ParseRoom(room); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	allowed, err := chat.CanJoin(db, userID, c.GetString("role"), room)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !allowed {
+		return http.StatusForbidden, fmt.Errorf("access to room denied")
+	}
+
+	// A ban keeps the user out of the room's history as well as its socket
+	sanction, err := chat.ActiveSanction(db, userID, room)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if sanction == chat.SanctionBan {
+		return http.StatusForbidden, fmt.Errorf("you are banned from this room")
+	}
+
+	return http.StatusOK, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"online-learning-golang/auth"
 	"online-learning-golang/models"
 	"online-learning-golang/utils"
 	"strconv"
@@ -667,6 +668,7 @@ func GetCourses(db *sql.DB) gin.HandlerFunc {
 // @Param        courseId   formData      int     true   "Course ID"
 // @Success      200        {object}  models.Message
 // @Failure      400        {object}  models.Error
+// @Failure      403        {object}  models.Error
 // @Failure      404        {object}  models.Error
 // @Failure      500        {object}  models.Error
 // @Router       /courses/activate [post]
@@ -683,7 +685,8 @@ func ActivateCourseForUser(db *sql.DB) gin.HandlerFunc {
 		}
 
 		var userID int
-		err := db.QueryRow("SELECT id FROM users WHERE email = ?", activationRequest.Email).Scan(&userID)
+		var emailVerified bool
+		err := db.QueryRow("SELECT id, emailVerifiedAt IS NOT NULL FROM users WHERE email = ?", activationRequest.Email).Scan(&userID, &emailVerified)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				c.JSON(http.StatusNotFound, models.Error{Error: "User with the given email not found"})
@@ -693,6 +696,11 @@ func ActivateCourseForUser(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !emailVerified && auth.VerificationRequiredForCourses() {
+			c.JSON(http.StatusForbidden, models.Error{Error: "User has not verified their email address"})
+			return
+		}
+
 		_, err = db.Exec("INSERT INTO user_courses (userId, courseId) VALUES (?, ?)", userID, activationRequest.CourseID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to activate course for user"})
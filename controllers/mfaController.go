@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"database/sql"
+	"net/http"
+	"online-learning-golang/auth"
+	"online-learning-golang/models"
+	"online-learning-golang/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mfaTokenTTL           = 5 * time.Minute
+	mfaEnrollmentTokenTTL = 15 * time.Minute
+)
+
+// mfaCodeError answers a failed second-factor check.
+func mfaCodeError(c *gin.Context, err error) {
+	switch err {
+	case auth.ErrInvalidMFACode:
+		c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid authentication code"})
+	case auth.ErrTooManyMFAAttempts:
+		c.JSON(http.StatusTooManyRequests, models.Error{Error: "Too many invalid codes, please try again later"})
+	case auth.ErrMFANotEnabled:
+		c.JSON(http.StatusBadRequest, models.Error{Error: "Two-factor authentication is not enabled"})
+	default:
+		c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to check authentication code"})
+	}
+}
+
+// VerifyMFA godoc
+// @Summary Complete login with a second factor
+// @Description Exchange the MFA token from login and a code from the authenticator app, or a recovery code, for access tokens. Each MFA token completes one login
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param request body models.MFAVerifyRequest true "MFA token and code"
+// @Success 200 {object} models.LoginResponse
+// @Failure 400 {object} models.Error
+// @Failure 401 {object} models.Error "Invalid or expired token or code"
+// @Failure 429 {object} models.Error "Too many invalid codes"
+// @Failure 500 {object} models.Error
+// @Router /auth/mfa/verify [post]
+func VerifyMFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.MFAVerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "MFA token and code are required"})
+			return
+		}
+
+		claims, err := utils.ValidToken(req.MFAToken, utils.TokenTypeMFA)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid or expired MFA token, please log in again"})
+			return
+		}
+
+		err = auth.VerifyMFALogin(db, claims.UserID, req.Code, claims.ID, claims.ExpiresAt)
+		if err == auth.ErrMFATokenUsed {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "MFA token has already been used, please log in again"})
+			return
+		}
+		if err != nil {
+			mfaCodeError(c, err)
+			return
+		}
+
+		user, err := GetUserDetail(db, strconv.Itoa(claims.UserID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusUnauthorized, models.Error{Error: "User not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to fetch user details"})
+			return
+		}
+
+		completeLogin(c, db, user)
+	}
+}
+
+// GetMFAStatus godoc
+// @Summary Get two-factor authentication status
+// @Description Get whether the current user has two-factor authentication enabled or required, and how many recovery codes are left
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} models.MFAStatusResponse
+// @Failure 401 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /auth/mfa [get]
+func GetMFAStatus(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		enabled, err := auth.MFAEnabled(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to check two-factor authentication"})
+			return
+		}
+
+		codesLeft, err := auth.RecoveryCodesLeft(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to count recovery codes"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.MFAStatusResponse{
+			Enabled:           enabled,
+			Required:          auth.MFARequired(c.GetString("role")),
+			RecoveryCodesLeft: codesLeft,
+		})
+	}
+}
+
+// SetupMFA godoc
+// @Summary Start two-factor authentication setup
+// @Description Generate a TOTP secret and its otpauth URI, to be shown as a QR code. Accepts an access token or the enrollment token from login
+// @Tags Authentication
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} models.MFASetupResponse
+// @Failure 401 {object} models.Error
+// @Failure 409 {object} models.Error "Already enabled"
+// @Failure 500 {object} models.Error
+// @Router /auth/mfa/setup [post]
+func SetupMFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userId")
+		user, err := GetUserDetail(db, userID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		secret, err := auth.StartMFASetup(db, user.ID)
+		if err == auth.ErrMFAAlreadyEnabled {
+			c.JSON(http.StatusConflict, models.Error{Error: "Two-factor authentication is already enabled"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to start two-factor authentication setup"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.MFASetupResponse{
+			Secret:     secret,
+			OTPAuthURI: auth.TOTPURI(auth.MFAIssuer(), user.Email, secret),
+		})
+	}
+}
+
+// ConfirmMFA godoc
+// @Summary Confirm two-factor authentication setup
+// @Description Enable two-factor authentication with a code from the authenticator app. Returns recovery codes, which are shown only once. Users who set up 2FA with an enrollment token log in again afterwards
+// @Tags Authentication
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body models.MFACodeRequest true "Code from the authenticator app"
+// @Success 200 {object} models.RecoveryCodesResponse
+// @Failure 400 {object} models.Error
+// @Failure 401 {object} models.Error "Invalid code"
+// @Failure 409 {object} models.Error "Already enabled"
+// @Failure 500 {object} models.Error
+// @Router /auth/mfa/confirm [post]
+func ConfirmMFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		var req models.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Code is required"})
+			return
+		}
+
+		codes, err := auth.ConfirmMFASetup(db, userID, req.Code)
+		switch err {
+		case nil:
+		case auth.ErrMFASetupNotStarted:
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Two-factor authentication setup has not been started"})
+			return
+		case auth.ErrMFAAlreadyEnabled:
+			c.JSON(http.StatusConflict, models.Error{Error: "Two-factor authentication is already enabled"})
+			return
+		case auth.ErrInvalidMFACode:
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid authentication code"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to enable two-factor authentication"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.RecoveryCodesResponse{
+			Message:       "Two-factor authentication enabled",
+			RecoveryCodes: codes,
+		})
+	}
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary Regenerate recovery codes
+// @Description Replace all recovery codes of the current user. Requires a current code
+// @Tags Authentication
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body models.MFACodeRequest true "Code from the authenticator app or a recovery code"
+// @Success 200 {object} models.RecoveryCodesResponse
+// @Failure 400 {object} models.Error
+// @Failure 401 {object} models.Error "Invalid code"
+// @Failure 403 {object} models.Error "Not allowed with an API key"
+// @Failure 429 {object} models.Error "Too many invalid codes"
+// @Failure 500 {object} models.Error
+// @Router /auth/mfa/recovery-codes [post]
+func RegenerateRecoveryCodes(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		var req models.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Code is required"})
+			return
+		}
+
+		codes, err := auth.RegenerateRecoveryCodes(db, userID, req.Code)
+		if err != nil {
+			mfaCodeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.RecoveryCodesResponse{
+			Message:       "Recovery codes regenerated",
+			RecoveryCodes: codes,
+		})
+	}
+}
+
+// DisableMFA godoc
+// @Summary Disable two-factor authentication
+// @Description Turn two-factor authentication off for the current user. Requires a current code. Not allowed when 2FA is mandatory for the user's role
+// @Tags Authentication
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body models.MFACodeRequest true "Code from the authenticator app or a recovery code"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error
+// @Failure 401 {object} models.Error "Invalid code"
+// @Failure 403 {object} models.Error "2FA is mandatory, or not allowed with an API key"
+// @Failure 429 {object} models.Error "Too many invalid codes"
+// @Failure 500 {object} models.Error
+// @Router /auth/mfa [delete]
+func DisableMFA(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		if auth.MFARequired(c.GetString("role")) {
+			c.JSON(http.StatusForbidden, models.Error{Error: "Two-factor authentication is mandatory for your role"})
+			return
+		}
+
+		var req models.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Code is required"})
+			return
+		}
+
+		if err := auth.DisableMFA(db, userID, req.Code); err != nil {
+			mfaCodeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "Two-factor authentication disabled"})
+	}
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"database/sql"
+	"net/http"
+	"online-learning-golang/models"
+	"online-learning-golang/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetNotifications godoc
+// @Summary Get notifications
+// @Description Get the current user's notifications, newest first, paged by notification ID
+// @Tags Notification
+// @Security BearerAuth
+// @Produce json
+// @Param unread query bool false "Only unread notifications"
+// @Param before query int false "Only notifications older than this ID"
+// @Param limit query int false "Number of notifications" default(20)
+// @Success 200 {object} models.NotificationsResponse
+// @Failure 401 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /notifications/ [get]
+func GetNotifications(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		query := `
+			SELECT id, type, COALESCE(actorId, 0), COALESCE(room, ''), COALESCE(messageId, 0), content, readAt IS NOT NULL, createdAt
+			FROM notifications
+			WHERE userId = ?`
+		args := []interface{}{userID}
+
+		if c.Query("unread") == "true" {
+			query += " AND readAt IS NULL"
+		}
+		if before, _ := strconv.Atoi(c.Query("before")); before > 0 {
+			query += " AND id < ?"
+			args = append(args, before)
+		}
+		query += " ORDER BY id DESC LIMIT ?"
+		args = append(args, utils.ClampInt(utils.ParseIntWithDefault(c.Query("limit"), 20), 1, 100))
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to fetch notifications"})
+			return
+		}
+		defer rows.Close()
+
+		notifications := []models.Notification{}
+		for rows.Next() {
+			var n models.Notification
+			var createdAt time.Time
+			if err := rows.Scan(&n.ID, &n.Type, &n.ActorID, &n.Room, &n.MessageID, &n.Content, &n.Read, &createdAt); err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to read notifications"})
+				return
+			}
+			n.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+			notifications = append(notifications, n)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to read notifications"})
+			return
+		}
+
+		var unreadCount int
+		err = db.QueryRow("SELECT COUNT(*) FROM notifications WHERE userId = ? AND readAt IS NULL", userID).Scan(&unreadCount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to count notifications"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.NotificationsResponse{
+			Notifications: notifications,
+			UnreadCount:   unreadCount,
+		})
+	}
+}
+
+// MarkNotificationRead godoc
+// @Summary Mark a notification as read
+// @Description Mark one of the current user's notifications as read
+// @Tags Notification
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Notification ID"
+// @Success 200 {object} models.Message
+// @Failure 400 {object} models.Error
+// @Failure 404 {object} models.Error
+// @Failure 500 {object} models.Error
+// @Router /notifications/{id}/read [put]
+func MarkNotificationRead(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		notificationID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid notification ID"})
+			return
+		}
+
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM notifications WHERE id = ? AND userId = ?)", notificationID, userID).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to fetch notification"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Notification not found"})
+			return
+		}
+
+		_, err = db.Exec("UPDATE notifications SET readAt = ? WHERE id = ? AND readAt IS NULL", time.Now().UTC(), notificationID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to update notification"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "Notification marked as read"})
+	}
+}
+
+// MarkAllNotificationsRead godoc
+// @Summary Mark all notifications as read
+// @Description Mark every unread notification of the current user as read
+// @Tags Notification
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} models.Message
+// @Failure 500 {object} models.Error
+// @Router /notifications/read [put]
+func MarkAllNotificationsRead(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.GetString("userId"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Invalid user ID"})
+			return
+		}
+
+		_, err = db.Exec("UPDATE notifications SET readAt = ? WHERE userId = ? AND readAt IS NULL", time.Now().UTC(), userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to update notifications"})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.Message{Message: "Notifications marked as read"})
+	}
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"online-learning-golang/auth"
+	"online-learning-golang/models"
+	"online-learning-golang/utils"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// oidcDefaultDateOfBirth fills the required date of birth of accounts created
+// from a provider, which does not share it. Users can correct it in their
+// profile.
+const oidcDefaultDateOfBirth = "2000-01-01"
+
+// oidcStateCookie ties a login to the browser that started it. It holds the
+// hash of the state, so a callback link made by someone else is refused.
+const oidcStateCookie = "oidcState"
+
+var (
+	errOIDCEmailNotVerified = errors.New("provider did not share a verified email")
+	errOIDCAccountDisabled  = errors.New("account with this email has been deleted")
+	usernameUnsafeChars     = regexp.MustCompile(`[^a-z0-9_.]`)
+)
+
+// GetOIDCProviders godoc
+// @Summary List identity providers
+// @Description List the identity providers users can sign in with
+// @Tags Authentication
+// @Produce json
+// @Success 200 {object} models.OIDCProvidersResponse
+// @Router /auth/oidc/providers [get]
+func GetOIDCProviders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, models.OIDCProvidersResponse{Providers: auth.OIDCProviderNames()})
+	}
+}
+
+// StartOIDCLogin godoc
+// @Summary Start signing in with an identity provider
+// @Description Start an authorization code flow with PKCE. Send the user to the returned URL; the provider redirects them back to the frontend with a code and state for /auth/oidc/{provider}/callback. The login is tied to this browser with an HttpOnly cookie
+// @Tags Authentication
+// @Produce json
+// @Param provider path string true "Provider name"
+// @Success 200 {object} models.OIDCAuthorizeResponse "Sets the login state cookie"
+// @Failure 404 {object} models.Error "Unknown provider"
+// @Failure 502 {object} models.Error "Provider unreachable"
+// @Failure 500 {object} models.Error
+// @Router /auth/oidc/{provider}/authorize [get]
+func StartOIDCLogin(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, err := auth.GetOIDCProvider(c.Param("provider"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Unknown identity provider"})
+			return
+		}
+
+		authURL, state, err := auth.BeginOIDCLogin(auth.NewOIDCStateStore(db), provider)
+		if err != nil {
+			log.Printf("Error starting %s login: %v", provider.Name, err)
+			c.JSON(http.StatusBadGateway, models.Error{Error: "Failed to start sign in with " + provider.Name})
+			return
+		}
+
+		setOIDCStateCookie(c, auth.HashToken(state), int(auth.OIDCLoginTTL.Seconds()))
+
+		c.JSON(http.StatusOK, models.OIDCAuthorizeResponse{AuthorizationURL: authURL})
+	}
+}
+
+// OIDCCallback godoc
+// @Summary Finish signing in with an identity provider
+// @Description Exchange the code and state the provider redirected back with, from the browser that started the login. The external identity is linked to the account with the same verified email, or a new account is created. Responds like /auth/login
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param provider path string true "Provider name"
+// @Param request body models.OIDCCallbackRequest true "Code and state from the provider redirect"
+// @Success 200 {object} models.LoginResponse
+// @Success 200 {object} models.MFAChallengeResponse "Second factor required"
+// @Failure 400 {object} models.Error "Invalid or expired state, or started in another browser"
+// @Failure 401 {object} models.Error "Provider rejected the login"
+// @Failure 403 {object} models.Error "No verified email or account deleted"
+// @Failure 404 {object} models.Error "Unknown provider"
+// @Failure 500 {object} models.Error
+// @Router /auth/oidc/{provider}/callback [post]
+func OIDCCallback(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, err := auth.GetOIDCProvider(c.Param("provider"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, models.Error{Error: "Unknown identity provider"})
+			return
+		}
+
+		var req models.OIDCCallbackRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" || req.State == "" {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Code and state are required"})
+			return
+		}
+
+		// Only the browser that started the login may finish it, or anyone
+		// could sign a victim in to their own account with their callback link
+		stateHash, err := c.Cookie(oidcStateCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(stateHash), []byte(auth.HashToken(req.State))) != 1 {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid or expired login state, please try again"})
+			return
+		}
+		clearOIDCStateCookie(c)
+
+		identity, err := auth.FinishOIDCLogin(auth.NewOIDCStateStore(db), provider, req.Code, req.State)
+		if err == auth.ErrInvalidOIDCState {
+			c.JSON(http.StatusBadRequest, models.Error{Error: "Invalid or expired login state, please try again"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error finishing %s login: %v", provider.Name, err)
+			c.JSON(http.StatusUnauthorized, models.Error{Error: "Failed to sign in with " + provider.Name})
+			return
+		}
+
+		user, err := findOrCreateOIDCUser(db, identity)
+		switch {
+		case err == errOIDCEmailNotVerified || err == errOIDCAccountDisabled:
+			c.JSON(http.StatusForbidden, models.Error{Error: err.Error()})
+			return
+		case err != nil:
+			log.Printf("Error signing in %s identity %s: %v", provider.Name, identity.Subject, err)
+			c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to sign in"})
+			return
+		}
+
+		continueLogin(c, db, user)
+	}
+}
+
+// findOrCreateOIDCUser returns the user an external identity belongs to. A
+// new identity is linked to the account with its verified email, or gets a
+// new account.
+func findOrCreateOIDCUser(db *sql.DB, identity *auth.OIDCIdentity) (models.UserDetail, error) {
+	userID, err := auth.LinkedUserID(db, identity)
+	if err == nil {
+		return GetUserDetail(db, strconv.Itoa(userID))
+	}
+	if err != sql.ErrNoRows {
+		return models.UserDetail{}, err
+	}
+
+	if !identity.HasVerifiedEmail() {
+		return models.UserDetail{}, errOIDCEmailNotVerified
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return models.UserDetail{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var deletedAt sql.NullTime
+	err = tx.QueryRow("SELECT id, deletedAt FROM users WHERE LOWER(email) = ? FOR UPDATE", identity.Email).Scan(&userID, &deletedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		userID, err = createOIDCUser(tx, identity)
+		if err != nil {
+			return models.UserDetail{}, err
+		}
+	case err != nil:
+		return models.UserDetail{}, fmt.Errorf("failed to check existing user: %v", err)
+	case deletedAt.Valid:
+		return models.UserDetail{}, errOIDCAccountDisabled
+	default:
+		// The provider has verified the address, so we can trust it too
+		_, err = tx.Exec("UPDATE users SET emailVerifiedAt = COALESCE(emailVerifiedAt, ?) WHERE id = ?", time.Now(), userID)
+		if err != nil {
+			return models.UserDetail{}, fmt.Errorf("failed to verify email: %v", err)
+		}
+	}
+
+	if err := auth.LinkIdentity(tx, userID, identity); err != nil {
+		return models.UserDetail{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.UserDetail{}, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return GetUserDetail(db, strconv.Itoa(userID))
+}
+
+func clearOIDCStateCookie(c *gin.Context) {
+	setOIDCStateCookie(c, "", -1)
+}
+
+func setOIDCStateCookie(c *gin.Context, stateHash string, maxAge int) {
+	// Lax keeps the cookie off cross-site requests, such as a forged
+	// callback, and leaves later cookies of the response as they were
+	c.SetSameSite(http.SameSiteLaxMode)
+	defer c.SetSameSite(http.SameSiteDefaultMode)
+	c.SetCookie(
+		oidcStateCookie,
+		stateHash,
+		maxAge,
+		"/",
+		os.Getenv("COOKIE_DOMAIN"),
+		os.Getenv("ENV") == "production", // Secure
+		true,                             // HttpOnly
+	)
+}
+
+func truncateRunes(value string, max int) string {
+	runes := []rune(value)
+	if len(runes) > max {
+		return string(runes[:max])
+	}
+	return value
+}
+
+// oidcUsername derives a free username from the email's local part.
+func oidcUsername(tx *sql.Tx, email string) (string, error) {
+	base := usernameUnsafeChars.ReplaceAllString(strings.ToLower(strings.Split(email, "@")[0]), "")
+	if len(base) < 3 {
+		base = "user" + base
+	}
+	base = truncateRunes(base, 15)
+
+	candidate := base
+	for attempt := 0; attempt < 5; attempt++ {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", candidate).Scan(&exists)
+		if err != nil {
+			return "", fmt.Errorf("failed to check username: %v", err)
+		}
+		if !exists {
+			return candidate, nil
+		}
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate username: %v", err)
+		}
+		candidate = fmt.Sprintf("%s%04d", base, suffix.Int64())
+	}
+	return "", fmt.Errorf("failed to find a free username for %s", email)
+}
+
+func createOIDCUser(tx *sql.Tx, identity *auth.OIDCIdentity) (int, error) {
+	if len(identity.Email) > 50 {
+		return 0, fmt.Errorf("email %s is too long", identity.Email)
+	}
+
+	username, err := oidcUsername(tx, identity.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	fullName := strings.TrimSpace(identity.Name)
+	if fullName == "" {
+		fullName = username
+	}
+
+	avatar := identity.Picture
+	if len(avatar) > 255 {
+		avatar = ""
+	}
+
+	// The account can only be signed in to through the provider until the
+	// user sets a password with the forgot password flow
+	randomPassword, err := utils.GenerateResetToken()
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate password: %v", err)
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO users (email, username, fullName, password, avatar, dateOfBirth, role, emailVerifiedAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		identity.Email, username, truncateRunes(fullName, 50), hashedPassword,
+		avatar, oidcDefaultDateOfBirth, models.RoleUser, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to register user: %v", err)
+	}
+
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get created user ID: %v", err)
+	}
+	return int(userID), nil
+}
@@ -3,9 +3,12 @@ package controllers
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"net/http"
+	"online-learning-golang/auth"
 	"online-learning-golang/models"
 	"online-learning-golang/utils"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -52,15 +55,20 @@ func createUserCommon(db *sql.DB, user *models.CreateUserRequest) (*models.UserD
 		return nil, fmt.Errorf("failed to get created user ID: %v", err)
 	}
 
+	verificationToken, err := auth.IssueEmailVerification(tx, int(userID))
+	if err != nil {
+		return nil, err
+	}
+
 	// Fetch the created user
 	var createdUser models.UserDetail
 	err = tx.QueryRow(`
-		SELECT id, email, username, fullName, gender, avatar, dateOfBirth, role, phoneNumber 
+		SELECT id, email, username, fullName, gender, avatar, dateOfBirth, role, emailVerifiedAt IS NOT NULL
 		FROM users WHERE id = ?`,
 		userID).Scan(
 		&createdUser.ID, &createdUser.Email, &createdUser.Username,
 		&createdUser.FullName, &createdUser.Gender, &createdUser.Avatar,
-		&createdUser.DateOfBirth, &createdUser.Role)
+		&createdUser.DateOfBirth, &createdUser.Role, &createdUser.EmailVerified)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch created user: %v", err)
 	}
@@ -69,6 +77,11 @@ func createUserCommon(db *sql.DB, user *models.CreateUserRequest) (*models.UserD
 		return nil, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
+	// The account exists either way, the user can ask for another email
+	if err := utils.SendVerificationEmail(createdUser.Email, verificationToken); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", createdUser.ID, err)
+	}
+
 	return &createdUser, nil
 }
 
@@ -209,9 +222,26 @@ func UpdateUser(db *sql.DB) gin.HandlerFunc {
 		}
 		defer tx.Rollback()
 
+		var currentEmail string
+		err = tx.QueryRow("SELECT email FROM users WHERE id = ? AND deletedAt IS NULL FOR UPDATE", userID).Scan(&currentEmail)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, models.Error{
+					Error: "User not found",
+				})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, models.Error{
+				Error: "Failed to fetch user",
+			})
+			return
+		}
+		emailChanged := !strings.EqualFold(currentEmail, updateUser.Email)
+
 		query := `
 			UPDATE users 
-			SET email = ?, 
+			SET emailVerifiedAt = IF(?, NULL, emailVerifiedAt),
+				email = ?, 
 				username = ?, 
 				fullName = ?, 
 				gender = ?, 
@@ -219,6 +249,7 @@ func UpdateUser(db *sql.DB) gin.HandlerFunc {
 			WHERE id = ? AND deletedAt IS NULL`
 
 		result, err := tx.Exec(query,
+			emailChanged,
 			updateUser.Email,
 			updateUser.Username,
 			updateUser.FullName,
@@ -241,6 +272,27 @@ func UpdateUser(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Links sent to the old address must not verify the new one
+		var verificationToken string
+		if emailChanged {
+			_, err = tx.Exec("DELETE FROM email_verification_tokens WHERE userId = ?", userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{
+					Error: "Failed to clear verification tokens",
+				})
+				return
+			}
+
+			id, _ := strconv.Atoi(userID)
+			verificationToken, err = auth.IssueEmailVerification(tx, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.Error{
+					Error: "Failed to generate verification token",
+				})
+				return
+			}
+		}
+
 		if err := tx.Commit(); err != nil {
 			c.JSON(http.StatusInternalServerError, models.Error{
 				Error: "Failed to commit transaction",
@@ -248,6 +300,12 @@ func UpdateUser(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if verificationToken != "" {
+			if err := utils.SendVerificationEmail(updateUser.Email, verificationToken); err != nil {
+				log.Printf("Error sending verification email to user %s: %v", userID, err)
+			}
+		}
+
 		// Fetch updated user details
 		updatedUser, err := GetUserDetail(db, userID)
 		if err != nil {
@@ -699,6 +757,7 @@ func GetUsers(db *sql.DB) gin.HandlerFunc {
 				&user.Avatar,
 				&user.DateOfBirth,
 				&user.Role,
+				&user.EmailVerified,
 			); err != nil {
 				c.JSON(http.StatusInternalServerError, models.Error{Error: "Failed to scan user data"})
 				return
@@ -718,10 +777,10 @@ func GetUsers(db *sql.DB) gin.HandlerFunc {
 }
 
 func GetUserDetail(db *sql.DB, id string) (models.UserDetail, error) {
-	row := db.QueryRow("SELECT id, email, username, fullName, gender, avatar, dateOfBirth, role FROM users WHERE id = ? AND deletedAt IS NULL", id)
+	row := db.QueryRow("SELECT id, email, username, fullName, gender, avatar, dateOfBirth, role, emailVerifiedAt IS NOT NULL FROM users WHERE id = ? AND deletedAt IS NULL", id)
 
 	var user models.UserDetail
-	if err := row.Scan(&user.ID, &user.Email, &user.Username, &user.FullName, &user.Gender, &user.Avatar, &user.DateOfBirth, &user.Role); err != nil {
+	if err := row.Scan(&user.ID, &user.Email, &user.Username, &user.FullName, &user.Gender, &user.Avatar, &user.DateOfBirth, &user.Role, &user.EmailVerified); err != nil {
 		return user, err
 	}
 
@@ -766,7 +825,7 @@ func GetUserByID(db *sql.DB) gin.HandlerFunc {
 }
 
 func buildUserQuery(filters map[string]string) (string, string, []interface{}, []interface{}) {
-	baseQuery := "SELECT id, email, username, fullName, gender, avatar, dateOfBirth, role FROM users WHERE deletedAt IS NULL"
+	baseQuery := "SELECT id, email, username, fullName, gender, avatar, dateOfBirth, role, emailVerifiedAt IS NOT NULL FROM users WHERE deletedAt IS NULL"
 	countQuery := "SELECT COUNT(*) FROM users WHERE deletedAt IS NULL"
 
 	var params, countParams []interface{}
@@ -21,6 +21,114 @@ func DropResetPasswordTokensTable(db *sql.DB) error {
 	return nil
 }
 
+func DropEmailVerificationTokensTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS email_verification_tokens;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop email_verification_tokens table: %w", err)
+	}
+	return nil
+}
+
+func DropUserMFATable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS user_mfa;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop user_mfa table: %w", err)
+	}
+	return nil
+}
+
+func DropMFARecoveryCodesTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS mfa_recovery_codes;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop mfa_recovery_codes table: %w", err)
+	}
+	return nil
+}
+
+func DropUsedMFATokensTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS used_mfa_tokens;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop used_mfa_tokens table: %w", err)
+	}
+	return nil
+}
+
+func DropAuthThrottlesTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS auth_throttles;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop auth_throttles table: %w", err)
+	}
+	return nil
+}
+
+func DropAccountUnlockTokensTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS account_unlock_tokens;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop account_unlock_tokens table: %w", err)
+	}
+	return nil
+}
+
+func DropMagicLinkTokensTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS magic_link_tokens;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop magic_link_tokens table: %w", err)
+	}
+	return nil
+}
+
+func DropUserIdentitiesTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS user_identities;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop user_identities table: %w", err)
+	}
+	return nil
+}
+
+func DropOIDCLoginStatesTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS oidc_login_states;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop oidc_login_states table: %w", err)
+	}
+	return nil
+}
+
+func DropAPIKeysTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS api_keys;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop api_keys table: %w", err)
+	}
+	return nil
+}
+
+func DropRefreshTokensTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS refresh_tokens;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop refresh_tokens table: %w", err)
+	}
+	return nil
+}
+
+func DropUserSessionsTable(db *sql.DB) error {
+	query := "DROP TABLE IF EXISTS user_sessions;"
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop user_sessions table: %w", err)
+	}
+	return nil
+}
+
 func DropUsersTable(db *sql.DB) error {
 	query := "DROP TABLE IF EXISTS users;"
 	_, err := db.Exec(query)
@@ -86,6 +194,87 @@ func DropUserCoursesTable(db *sql.DB) error {
 	return nil
 }
 
+func DropChatTicketsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_tickets;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_tickets table: %w", err)
+	}
+	return nil
+}
+
+func DropChatConversationsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_conversations;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_conversations table: %w", err)
+	}
+	return nil
+}
+
+func DropChatReadStatesTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_read_states;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_read_states table: %w", err)
+	}
+	return nil
+}
+
+func DropChatMessageAuditsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_message_audits;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_message_audits table: %w", err)
+	}
+	return nil
+}
+
+func DropChatRoomSanctionsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_room_sanctions;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_room_sanctions table: %w", err)
+	}
+	return nil
+}
+
+func DropChatAttachmentsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_attachments;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_attachments table: %w", err)
+	}
+	return nil
+}
+
+func DropChatMessageReactionsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_message_reactions;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_message_reactions table: %w", err)
+	}
+	return nil
+}
+
+func DropChatMentionsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS chat_mentions;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop chat_mentions table: %w", err)
+	}
+	return nil
+}
+
+func DropNotificationsTable(db *sql.DB) error {
+	query := `DROP TABLE IF EXISTS notifications;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to drop notifications table: %w", err)
+	}
+	return nil
+}
+
 func DropChatMessagesTable(db *sql.DB) error {
 	query := `DROP TABLE IF EXISTS chat_messages;`
 	_, err := db.Exec(query)
@@ -107,6 +296,7 @@ func CreateUsersTable(db *sql.DB) error {
         avatar VARCHAR(255) NOT NULL DEFAULT "",
         dateOfBirth DATE NOT NULL,
         role ENUM('user', 'admin') NOT NULL DEFAULT 'user',
+        emailVerifiedAt TIMESTAMP NULL DEFAULT NULL,
         createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
         deletedAt TIMESTAMP NULL DEFAULT NULL
     );`
@@ -134,6 +324,250 @@ func CreateResetPasswordTokensTable(db *sql.DB) error {
 
 	return nil
 }
+
+func CreateEmailVerificationTokensTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS email_verification_tokens (
+		token VARCHAR(64) PRIMARY KEY,
+		userId INT NOT NULL,
+		expiry TIMESTAMP NOT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_email_verification_tokens_user (userId),
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create email_verification_tokens table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateUserMFATable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS user_mfa (
+		userId INT PRIMARY KEY,
+		secret VARCHAR(64) NOT NULL,
+		enabledAt TIMESTAMP NULL DEFAULT NULL,
+		lastUsedStep BIGINT NOT NULL DEFAULT 0,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create user_mfa table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateMFARecoveryCodesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		userId INT NOT NULL,
+		codeHash CHAR(64) NOT NULL,
+		usedAt TIMESTAMP NULL DEFAULT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_mfa_recovery_codes_user (userId, codeHash),
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create mfa_recovery_codes table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateUsedMFATokensTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS used_mfa_tokens (
+		tokenId CHAR(32) PRIMARY KEY,
+		expiresAt TIMESTAMP NOT NULL,
+		INDEX idx_used_mfa_tokens_expiry (expiresAt)
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create used_mfa_tokens table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateAuthThrottlesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS auth_throttles (
+		throttleKey VARCHAR(128) PRIMARY KEY,
+		failures INT NOT NULL DEFAULT 0,
+		lastFailureAt TIMESTAMP NOT NULL,
+		blockedUntil TIMESTAMP NULL DEFAULT NULL,
+		expiresAt TIMESTAMP NOT NULL,
+		INDEX idx_auth_throttles_expiry (expiresAt)
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create auth_throttles table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateAccountUnlockTokensTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS account_unlock_tokens (
+		token VARCHAR(64) PRIMARY KEY,
+		userId INT NOT NULL,
+		expiry TIMESTAMP NOT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create account_unlock_tokens table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateMagicLinkTokensTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS magic_link_tokens (
+		token VARCHAR(64) PRIMARY KEY,
+		userId INT NOT NULL,
+		expiry TIMESTAMP NOT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create magic_link_tokens table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateUserIdentitiesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		userId INT NOT NULL,
+		provider VARCHAR(50) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_user_identities_subject (provider, subject),
+		INDEX idx_user_identities_user (userId),
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create user_identities table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateOIDCLoginStatesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS oidc_login_states (
+		state CHAR(64) PRIMARY KEY,
+		provider VARCHAR(50) NOT NULL,
+		nonce CHAR(64) NOT NULL,
+		codeVerifier VARCHAR(128) NOT NULL,
+		expiresAt TIMESTAMP NOT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_oidc_login_states_expiry (expiresAt)
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create oidc_login_states table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateAPIKeysTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		userId INT NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		prefix VARCHAR(16) NOT NULL,
+		keyHash CHAR(64) NOT NULL UNIQUE,
+		scopes VARCHAR(255) NOT NULL,
+		expiresAt TIMESTAMP NOT NULL,
+		lastUsedAt TIMESTAMP NULL DEFAULT NULL,
+		lastUsedIp VARCHAR(45) NOT NULL DEFAULT "",
+		revokedAt TIMESTAMP NULL DEFAULT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_api_keys_userId (userId),
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateUserSessionsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS user_sessions (
+		id CHAR(32) PRIMARY KEY,
+		userId INT NOT NULL,
+		userAgent VARCHAR(255) NOT NULL DEFAULT "",
+		ipAddress VARCHAR(45) NOT NULL DEFAULT "",
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		lastUsedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expiresAt TIMESTAMP NOT NULL,
+		revokedAt TIMESTAMP NULL DEFAULT NULL,
+		INDEX idx_user_sessions_userId (userId),
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create user_sessions table: %w", err)
+	}
+
+	return nil
+}
+
+func CreateRefreshTokensTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		userId INT NOT NULL,
+		familyId CHAR(32) NOT NULL,
+		tokenHash CHAR(64) NOT NULL UNIQUE,
+		expiresAt TIMESTAMP NOT NULL,
+		rotatedAt TIMESTAMP NULL DEFAULT NULL,
+		revokedAt TIMESTAMP NULL DEFAULT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_refresh_tokens_familyId (familyId),
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (familyId) REFERENCES user_sessions(id) ON DELETE CASCADE
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh_tokens table: %w", err)
+	}
+
+	return nil
+}
 func CreateClassesTable(db *sql.DB) error {
 	query := `
     CREATE TABLE IF NOT EXISTS classes (
@@ -243,27 +677,217 @@ func CreateUserCoursesTable(db *sql.DB) error {
 	return nil
 }
 
+func CreateChatTicketsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS chat_tickets (
+		token VARCHAR(64) PRIMARY KEY,
+		userId INT NOT NULL,
+		sessionId CHAR(32) NOT NULL,
+		expiry TIMESTAMP NOT NULL,
+		createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_tickets table: %w", err)
+	}
+	return nil
+}
+
 func CreateChatMessagesTable(db *sql.DB) error {
 	query := `
-    CREATE TABLE IF NOT EXISTS user_courses (
+    CREATE TABLE IF NOT EXISTS chat_messages (
         id INT AUTO_INCREMENT PRIMARY KEY,
+        room VARCHAR(64) NOT NULL DEFAULT 'lobby',
+        senderId INT NOT NULL,
+        parentId INT NULL DEFAULT NULL,
+        content TEXT NOT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        editedAt TIMESTAMP NULL DEFAULT NULL,
+        deletedAt TIMESTAMP NULL DEFAULT NULL,
+        deletedBy INT NULL DEFAULT NULL,
+        INDEX idx_chat_messages_room_id (room, id, senderId, deletedAt),
+        INDEX idx_chat_messages_room_createdAt (room, createdAt),
+        INDEX idx_chat_messages_parentId_id (parentId, id),
+        FULLTEXT INDEX idx_chat_messages_content (content),
+        FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY (parentId) REFERENCES chat_messages(id) ON DELETE SET NULL,
+        FOREIGN KEY (deletedBy) REFERENCES users(id) ON DELETE SET NULL
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_messages table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatConversationsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_conversations (
+        room VARCHAR(64) PRIMARY KEY,
+        userOneId INT NOT NULL,
+        userTwoId INT NOT NULL,
+        lastMessageId INT NOT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+        FOREIGN KEY (userOneId) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY (userTwoId) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY (lastMessageId) REFERENCES chat_messages(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_conversations table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatReadStatesTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_read_states (
         userId INT NOT NULL,
-        courseId INT NOT NULL,
+        room VARCHAR(64) NOT NULL,
+        lastReadMessageId INT NOT NULL DEFAULT 0,
+        updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+        PRIMARY KEY (userId, room),
+        FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_read_states table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatMessageAuditsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_message_audits (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        messageId INT NOT NULL,
+        action ENUM('edit', 'delete') NOT NULL,
+        actorId INT NOT NULL,
+        previousContent TEXT NOT NULL,
         createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (messageId) REFERENCES chat_messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (actorId) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_message_audits table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatRoomSanctionsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_room_sanctions (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        room VARCHAR(64) NOT NULL,
+        userId INT NOT NULL,
+        type ENUM('mute', 'ban') NOT NULL,
+        reason VARCHAR(255) NOT NULL DEFAULT "",
+        createdBy INT NOT NULL,
+        expiresAt TIMESTAMP NOT NULL,
+        liftedAt TIMESTAMP NULL DEFAULT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        INDEX idx_chat_room_sanctions_room_userId (room, userId),
         FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE,
-        FOREIGN KEY (courseId) REFERENCES courses(id) ON DELETE CASCADE
+        FOREIGN KEY (createdBy) REFERENCES users(id) ON DELETE CASCADE
     );`
 	_, err := db.Exec(query)
 	if err != nil {
-		return fmt.Errorf("failed to create user_courses table: %w", err)
+		return fmt.Errorf("failed to create chat_room_sanctions table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatAttachmentsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_attachments (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        messageId INT NULL DEFAULT NULL,
+        uploaderId INT NOT NULL,
+        url VARCHAR(512) NOT NULL,
+        fileName VARCHAR(255) NOT NULL,
+        mimeType VARCHAR(100) NOT NULL,
+        size BIGINT NOT NULL,
+        width INT NULL DEFAULT NULL,
+        height INT NULL DEFAULT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        INDEX idx_chat_attachments_messageId (messageId),
+        FOREIGN KEY (messageId) REFERENCES chat_messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (uploaderId) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_attachments table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatMessageReactionsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_message_reactions (
+        messageId INT NOT NULL,
+        userId INT NOT NULL,
+        emoji VARCHAR(32) NOT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (messageId, userId, emoji),
+        FOREIGN KEY (messageId) REFERENCES chat_messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_message_reactions table: %w", err)
+	}
+	return nil
+}
+
+func CreateChatMentionsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS chat_mentions (
+        messageId INT NOT NULL,
+        userId INT NOT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (messageId, userId),
+        INDEX idx_chat_mentions_userId (userId),
+        FOREIGN KEY (messageId) REFERENCES chat_messages(id) ON DELETE CASCADE,
+        FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create chat_mentions table: %w", err)
+	}
+	return nil
+}
+
+func CreateNotificationsTable(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS notifications (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        userId INT NOT NULL,
+        type VARCHAR(32) NOT NULL,
+        actorId INT NULL DEFAULT NULL,
+        room VARCHAR(64) NULL DEFAULT NULL,
+        messageId INT NULL DEFAULT NULL,
+        content VARCHAR(255) NOT NULL DEFAULT "",
+        readAt TIMESTAMP NULL DEFAULT NULL,
+        createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        INDEX idx_notifications_userId_id (userId, id),
+        FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY (actorId) REFERENCES users(id) ON DELETE SET NULL,
+        FOREIGN KEY (messageId) REFERENCES chat_messages(id) ON DELETE CASCADE
+    );`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create notifications table: %w", err)
 	}
 	return nil
 }
 
 func InsertTestAccounts(db *sql.DB) error {
 	query := `
-	INSERT INTO users (email, username, fullName, password, gender, dateOfBirth, role)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO users (email, username, fullName, password, gender, dateOfBirth, role, emailVerifiedAt)
+	VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 	`
 
 	gofakeit.Seed(0)
@@ -552,6 +1176,18 @@ func CreateAllTablesIfNotExist(db *sql.DB) error {
 	}{
 		{"users", CreateUsersTable, InsertTestAccounts},
 		{"reset_pw_tokens", CreateResetPasswordTokensTable, NoInsert},
+		{"email_verification_tokens", CreateEmailVerificationTokensTable, NoInsert},
+		{"auth_throttles", CreateAuthThrottlesTable, NoInsert},
+		{"account_unlock_tokens", CreateAccountUnlockTokensTable, NoInsert},
+		{"magic_link_tokens", CreateMagicLinkTokensTable, NoInsert},
+		{"user_identities", CreateUserIdentitiesTable, NoInsert},
+		{"oidc_login_states", CreateOIDCLoginStatesTable, NoInsert},
+		{"user_mfa", CreateUserMFATable, NoInsert},
+		{"mfa_recovery_codes", CreateMFARecoveryCodesTable, NoInsert},
+		{"used_mfa_tokens", CreateUsedMFATokensTable, NoInsert},
+		{"user_sessions", CreateUserSessionsTable, NoInsert},
+		{"refresh_tokens", CreateRefreshTokensTable, NoInsert},
+		{"api_keys", CreateAPIKeysTable, NoInsert},
 		{"classes", CreateClassesTable, InsertClassesData},
 		{"subjects", CreateSubjectsTable, InsertSubjectsData},
 		{"documents", CreateDocumentsTable, InsertDocumentsData},
@@ -559,6 +1195,15 @@ func CreateAllTablesIfNotExist(db *sql.DB) error {
 		{"lessons", CreateLessonsTable, InsertLessonsData},
 		{"user_courses", CreateUserCoursesTable, NoInsert},
 		{"chat_messages", CreateChatMessagesTable, NoInsert},
+		{"chat_tickets", CreateChatTicketsTable, NoInsert},
+		{"chat_conversations", CreateChatConversationsTable, NoInsert},
+		{"chat_read_states", CreateChatReadStatesTable, NoInsert},
+		{"chat_message_audits", CreateChatMessageAuditsTable, NoInsert},
+		{"chat_room_sanctions", CreateChatRoomSanctionsTable, NoInsert},
+		{"chat_attachments", CreateChatAttachmentsTable, NoInsert},
+		{"chat_message_reactions", CreateChatMessageReactionsTable, NoInsert},
+		{"chat_mentions", CreateChatMentionsTable, NoInsert},
+		{"notifications", CreateNotificationsTable, NoInsert},
 	}
 
 	for _, table := range tables {
@@ -581,11 +1226,100 @@ func CreateAllTablesIfNotExist(db *sql.DB) error {
 		}
 	}
 
+	return migrateColumns(db)
+}
+
+// migrateColumns adds the columns that tables created by an older version
+// lack, since CREATE TABLE IF NOT EXISTS leaves existing tables as they are.
+func migrateColumns(db *sql.DB) error {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+		backfill   string
+	}{
+		// Accounts from before email verification count as verified, so
+		// requiring verification does not lock them out
+		{
+			"users", "emailVerifiedAt", "TIMESTAMP NULL DEFAULT NULL",
+			"UPDATE users SET emailVerifiedAt = COALESCE(createdAt, CURRENT_TIMESTAMP)",
+		},
+		// Every policy forgets failures after an hour
+		{
+			"auth_throttles", "expiresAt",
+			"TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, ADD INDEX idx_auth_throttles_expiry (expiresAt)",
+			"UPDATE auth_throttles SET expiresAt = GREATEST(lastFailureAt + INTERVAL 1 HOUR, COALESCE(blockedUntil, lastFailureAt))",
+		},
+	}
+
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition, c.backfill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds the column unless the table has it already, and
+// then runs backfill to fill it for the existing rows.
+func addColumnIfMissing(db *sql.DB, table, column, definition, backfill string) error {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+		)`, table, column).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check column %s.%s: %w", table, column, err)
+	}
+	if exists {
+		return nil
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	if backfill != "" {
+		if _, err := db.Exec(backfill); err != nil {
+			return fmt.Errorf("failed to backfill column %s.%s: %w", table, column, err)
+		}
+	}
 	return nil
 }
 
 func ResetDataBase(db *sql.DB) error {
 
+	if err := DropNotificationsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatMentionsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatMessageReactionsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatAttachmentsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatRoomSanctionsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatMessageAuditsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatReadStatesTable(db); err != nil {
+		return err
+	}
+	if err := DropChatConversationsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatTicketsTable(db); err != nil {
+		return err
+	}
+	if err := DropChatMessagesTable(db); err != nil {
+		return err
+	}
 	if err := DropUserCoursesTable(db); err != nil {
 		return err
 	}
@@ -606,6 +1340,42 @@ func ResetDataBase(db *sql.DB) error {
 		return err
 	}
 
+	if err := DropAPIKeysTable(db); err != nil {
+		return err
+	}
+	if err := DropRefreshTokensTable(db); err != nil {
+		return err
+	}
+	if err := DropUserSessionsTable(db); err != nil {
+		return err
+	}
+	if err := DropOIDCLoginStatesTable(db); err != nil {
+		return err
+	}
+	if err := DropUserIdentitiesTable(db); err != nil {
+		return err
+	}
+	if err := DropMagicLinkTokensTable(db); err != nil {
+		return err
+	}
+	if err := DropAccountUnlockTokensTable(db); err != nil {
+		return err
+	}
+	if err := DropAuthThrottlesTable(db); err != nil {
+		return err
+	}
+	if err := DropUsedMFATokensTable(db); err != nil {
+		return err
+	}
+	if err := DropMFARecoveryCodesTable(db); err != nil {
+		return err
+	}
+	if err := DropUserMFATable(db); err != nil {
+		return err
+	}
+	if err := DropEmailVerificationTokensTable(db); err != nil {
+		return err
+	}
 	if err := DropResetPasswordTokensTable(db); err != nil {
 		return err
 	}
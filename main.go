@@ -11,9 +11,11 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
 
+	"online-learning-golang/auth"
 	"online-learning-golang/database"
 	_ "online-learning-golang/docs"
 	"online-learning-golang/routes"
+	"online-learning-golang/utils"
 
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -60,6 +62,14 @@ func main() {
 		return
 	}
 
+	if err := utils.LoadKeyring(); err != nil {
+		log.Fatalf("Error loading JWT keys: %v", err)
+	}
+
+	if err := auth.LoadOIDCProviders(); err != nil {
+		log.Fatalf("Error loading identity providers: %v", err)
+	}
+
 	router := gin.New()
 	router.RedirectTrailingSlash = false
 
@@ -79,6 +89,8 @@ func main() {
 	routes.CourseRoutes(router.Group(apiPrefix+"/courses"), db)
 	routes.LessonRoutes(router.Group(apiPrefix+"/lessons"), db)
 	routes.ChatRoutes(router.Group(apiPrefix+"/chat"), db)
+	routes.NotificationRoutes(router.Group(apiPrefix+"/notifications"), db)
+	routes.WellKnownRoutes(router.Group("/.well-known"))
 
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
@@ -1,16 +1,20 @@
 package middleware
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"online-learning-golang/auth"
+	"online-learning-golang/models"
 	"online-learning-golang/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+func AuthMiddleware(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -19,22 +23,45 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		userId, role, err := utils.ValidToken(tokenStr)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		claims, ok := authenticateRequest(c, db, strings.TrimPrefix(authHeader, "Bearer "))
+		if !ok {
+			return
+		}
+
+		setClaims(c, claims)
+		c.Next()
+	}
+}
+
+func OnlyAdminMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
 			c.Abort()
 			return
 		}
 
-		userIdStr := strconv.Itoa(userId)
-		c.Set("userId", userIdStr)
-		c.Set("role", role)
+		claims, ok := authenticateRequest(c, db, strings.TrimPrefix(authHeader, "Bearer "))
+		if !ok {
+			return
+		}
+
+		if claims.Role != "admin" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied: Admins only"})
+			c.Abort()
+			return
+		}
+
+		setClaims(c, claims)
 		c.Next()
 	}
 }
 
-func OnlyAdminMiddleware() gin.HandlerFunc {
+// MFAEnrollmentMiddleware guards the two-factor setup endpoints. Besides
+// regular access tokens it accepts the enrollment token Login hands out to
+// users who must set up 2FA before they can log in.
+func MFAEnrollmentMiddleware(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -44,22 +71,102 @@ func OnlyAdminMiddleware() gin.HandlerFunc {
 		}
 
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		userId, role, err := utils.ValidToken(tokenStr)
+		claims, err := authenticate(db, tokenStr)
+		if err != nil {
+			claims, err = utils.ValidToken(tokenStr, utils.TokenTypeMFAEnrollment)
+		}
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		if role != "admin" {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied: Admins only"})
+		setClaims(c, claims)
+		c.Next()
+	}
+}
+
+// NoAPIKeyMiddleware keeps API keys away from the account's security
+// settings, such as 2FA, sessions and the keys themselves, which only the
+// user signed in with a password or provider may change. It goes after
+// AuthMiddleware.
+func NoAPIKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("apiKeyId") != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint cannot be used with an API key"})
 			c.Abort()
 			return
 		}
-
-		userIdStr := strconv.Itoa(userId)
-		c.Set("userId", userIdStr)
-		c.Set("role", role)
 		c.Next()
 	}
 }
+
+// authenticate validates an access token and checks that the session it was
+// issued for has not been signed out.
+func authenticate(db *sql.DB, tokenStr string) (*utils.TokenClaims, error) {
+	claims, err := utils.ValidToken(tokenStr, utils.TokenTypeAccess)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" {
+		return nil, fmt.Errorf("token has no session")
+	}
+
+	active, err := auth.SessionActive(db, claims.SessionID, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, fmt.Errorf("session has been revoked")
+	}
+	return claims, nil
+}
+
+// authenticateRequest accepts either an access token or an API key. It
+// answers the request itself when the credential is refused.
+func authenticateRequest(c *gin.Context, db *sql.DB, credential string) (*utils.TokenClaims, bool) {
+	if auth.IsAPIKey(credential) {
+		return authenticateAPIKey(c, db, credential)
+	}
+
+	claims, err := authenticate(db, credential)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return nil, false
+	}
+	return claims, true
+}
+
+// authenticateAPIKey checks an API key sent in place of an access token, and
+// that it was granted the scope the request method needs. Keys without the
+// admin scope act with user rights even for admins. It answers the request
+// itself when the key is refused.
+func authenticateAPIKey(c *gin.Context, db *sql.DB, key string) (*utils.TokenClaims, bool) {
+	identity, err := auth.AuthenticateAPIKey(db, key, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return nil, false
+	}
+
+	if scope := auth.RequiredScope(c.Request.Method); !identity.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+		c.Abort()
+		return nil, false
+	}
+
+	role := identity.Role
+	if !identity.HasScope(auth.ScopeAdmin) {
+		role = string(models.RoleUser)
+	}
+
+	c.Set("apiKeyId", strconv.Itoa(identity.KeyID))
+	return &utils.TokenClaims{UserID: identity.UserID, Role: role}, true
+}
+
+func setClaims(c *gin.Context, claims *utils.TokenClaims) {
+	c.Set("userId", strconv.Itoa(claims.UserID))
+	c.Set("role", claims.Role)
+	c.Set("sessionId", claims.SessionID)
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"online-learning-golang/auth"
+	"online-learning-golang/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Browsers cannot set headers on a WebSocket handshake, so besides the usual
+// Authorization header the token may be sent as a subprotocol
+// ("access_token, <token>") or exchanged beforehand for a one-time ticket.
+const WebSocketTokenProtocol = "access_token"
+
+func WebSocketAuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var claims *utils.TokenClaims
+		var err error
+
+		if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+			claims, err = authenticate(db, strings.TrimPrefix(authHeader, "Bearer "))
+		} else if token := tokenFromProtocols(c.Request); token != "" {
+			claims, err = authenticate(db, token)
+			c.Set("wsProtocol", WebSocketTokenProtocol)
+		} else if ticket := c.Query("ticket"); ticket != "" {
+			claims, err = redeemChatTicket(db, ticket)
+		} else {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
+			c.Abort()
+			return
+		}
+
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		setClaims(c, claims)
+		c.Next()
+	}
+}
+
+func tokenFromProtocols(r *http.Request) string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == WebSocketTokenProtocol {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+func redeemChatTicket(db *sql.DB, ticket string) (*utils.TokenClaims, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var claims utils.TokenClaims
+	var expiry time.Time
+	err = tx.QueryRow(`
+		SELECT t.userId, u.role, t.sessionId, t.expiry
+		FROM chat_tickets t
+		JOIN users u ON u.id = t.userId
+		WHERE t.token = ? AND u.deletedAt IS NULL
+		FOR UPDATE
+	`, ticket).Scan(&claims.UserID, &claims.Role, &claims.SessionID, &expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tickets are single use, whether or not they are still valid
+	if _, err = tx.Exec("DELETE FROM chat_tickets WHERE token = ?", ticket); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expiry) {
+		return nil, fmt.Errorf("ticket has expired")
+	}
+
+	active, err := auth.SessionActive(db, claims.SessionID, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, fmt.Errorf("session has been revoked")
+	}
+	return &claims, nil
+}
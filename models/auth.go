@@ -12,6 +12,43 @@ type LoginResponse struct {
 	ExpiresIn   int64      `json:"expiresIn" validate:"required"`
 }
 
+// MFAChallengeResponse is returned by login instead of tokens when a second
+// factor is needed. With MFARequired the MFA token is exchanged at
+// /auth/mfa/verify; with EnrollmentRequired it authorizes /auth/mfa/setup and
+// /auth/mfa/confirm.
+type MFAChallengeResponse struct {
+	Message            string `json:"message" validate:"required"`
+	MFARequired        bool   `json:"mfaRequired"`
+	EnrollmentRequired bool   `json:"enrollmentRequired"`
+	MFAToken           string `json:"mfaToken" validate:"required"`
+	ExpiresIn          int64  `json:"expiresIn" validate:"required"`
+}
+
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type MFAStatusResponse struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+type MFASetupResponse struct {
+	Secret     string `json:"secret" validate:"required"`
+	OTPAuthURI string `json:"otpauthUri" validate:"required"`
+}
+
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message" validate:"required"`
+	RecoveryCodes []string `json:"recoveryCodes" validate:"required"`
+}
+
 type AccessTokenResponse struct {
 	AccessToken string `json:"accessToken" validate:"required"`
 	ExpiresIn   int64  `json:"expiresIn" validate:"required"`
@@ -21,6 +58,68 @@ type ForgotPasswordRequest struct {
 	Email string `json:"email" validate:"required,email"`
 }
 
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
 type ResetPasswordRequest struct {
 	Password string `json:"password" validate:"required,min=6"`
 }
+
+// APIKey is a personal access token as shown to its owner. The key itself
+// is only stored hashed, and only returned once when it is created.
+type APIKey struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  string   `json:"expiresAt"`
+	LastUsedAt *string  `json:"lastUsedAt"`
+	LastUsedIP string   `json:"lastUsedIp"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type CreateAPIKeyResponse struct {
+	Message string `json:"message"`
+	Key     string `json:"key"`
+	APIKey  APIKey `json:"apiKey"`
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type OIDCProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+type OIDCAuthorizeResponse struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+}
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code" validate:"required"`
+	State string `json:"state" validate:"required"`
+}
@@ -3,8 +3,21 @@ package models
 import "time"
 
 type ChatMessage struct {
-    ID        uint      `gorm:"primaryKey" json:"id"`
-    Content   string    `json:"content"`
-    SenderID  int       `json:"senderId"`
-    CreatedAt time.Time `json:"createdAt"`
-} 
\ No newline at end of file
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Content   string    `json:"content"`
+	SenderID  int       `json:"senderId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ChatTicketResponse struct {
+	Ticket    string `json:"ticket" validate:"required"`
+	ExpiresIn int64  `json:"expiresIn" validate:"required"`
+}
+
+type CreateSanctionRequest struct {
+	Room            string `json:"room" validate:"required"`
+	UserID          int    `json:"userId" validate:"required"`
+	Type            string `json:"type" validate:"required,oneof=mute ban"`
+	DurationMinutes int    `json:"durationMinutes" validate:"required,min=1"`
+	Reason          string `json:"reason"`
+}
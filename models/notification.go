@@ -0,0 +1,17 @@
+package models
+
+type Notification struct {
+	ID        int    `json:"id" validate:"required"`
+	Type      string `json:"type" validate:"required"`
+	ActorID   int    `json:"actorId,omitempty"`
+	Room      string `json:"room,omitempty"`
+	MessageID int    `json:"messageId,omitempty"`
+	Content   string `json:"content"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"createdAt" validate:"required"`
+}
+
+type NotificationsResponse struct {
+	Notifications []Notification `json:"notifications" validate:"required"`
+	UnreadCount   int            `json:"unreadCount" validate:"required"`
+}
@@ -33,14 +33,15 @@ type CreateUserRequest struct {
 }
 
 type UserDetail struct {
-	ID          int        `json:"id" validate:"required"`
-	Email       string     `json:"email" validate:"required,email"`
-	Username    string     `json:"username" validate:"required"`
-	FullName    string     `json:"fullName" validate:"required"`
-	Gender      UserGender `json:"gender" validate:"required"`
-	Avatar      string     `json:"avatar" validate:"required"`
-	DateOfBirth string     `json:"dateOfBirth" validate:"required,datetime=2006-01-02"`
-	Role        UserRole   `json:"role" validate:"required"`
+	ID            int        `json:"id" validate:"required"`
+	Email         string     `json:"email" validate:"required,email"`
+	Username      string     `json:"username" validate:"required"`
+	FullName      string     `json:"fullName" validate:"required"`
+	Gender        UserGender `json:"gender" validate:"required"`
+	Avatar        string     `json:"avatar" validate:"required"`
+	DateOfBirth   string     `json:"dateOfBirth" validate:"required,datetime=2006-01-02"`
+	Role          UserRole   `json:"role" validate:"required"`
+	EmailVerified bool       `json:"emailVerified"`
 }
 
 type UserToken struct {
@@ -3,14 +3,35 @@ package routes
 import (
 	"database/sql"
 	"online-learning-golang/controllers"
+	"online-learning-golang/middleware"
 
 	"github.com/gin-gonic/gin"
 )
 
 func AuthRoutes(router *gin.RouterGroup, db *sql.DB) {
 	router.POST("/login", controllers.Login(db))
-	router.POST("/logout", controllers.Logout())
-	router.POST("/refresh-token", controllers.RefreshToken())
+	router.POST("/logout", controllers.Logout(db))
+	router.POST("/refresh-token", controllers.RefreshToken(db))
 	router.POST("/forgot-password", controllers.ForgotPassword(db))
 	router.POST("/reset-password", controllers.ResetPassword(db))
+	router.POST("/magic-link", controllers.RequestMagicLink(db))
+	router.POST("/magic-link/login", controllers.MagicLinkLogin(db))
+	router.POST("/unlock-account", controllers.UnlockAccount(db))
+	router.POST("/verify-email", controllers.VerifyEmail(db))
+	router.POST("/resend-verification", controllers.ResendVerificationEmail(db))
+	router.GET("/oidc/providers", controllers.GetOIDCProviders())
+	router.GET("/oidc/:provider/authorize", controllers.StartOIDCLogin(db))
+	router.POST("/oidc/:provider/callback", controllers.OIDCCallback(db))
+	router.POST("/mfa/verify", controllers.VerifyMFA(db))
+	router.GET("/mfa", middleware.AuthMiddleware(db), controllers.GetMFAStatus(db))
+	router.POST("/mfa/setup", middleware.MFAEnrollmentMiddleware(db), controllers.SetupMFA(db))
+	router.POST("/mfa/confirm", middleware.MFAEnrollmentMiddleware(db), controllers.ConfirmMFA(db))
+	router.POST("/mfa/recovery-codes", middleware.AuthMiddleware(db), middleware.NoAPIKeyMiddleware(), controllers.RegenerateRecoveryCodes(db))
+	router.DELETE("/mfa", middleware.AuthMiddleware(db), middleware.NoAPIKeyMiddleware(), controllers.DisableMFA(db))
+	router.GET("/api-keys", middleware.AuthMiddleware(db), controllers.GetAPIKeys(db))
+	router.POST("/api-keys", middleware.AuthMiddleware(db), middleware.NoAPIKeyMiddleware(), controllers.CreateAPIKey(db))
+	router.DELETE("/api-keys/:id", middleware.AuthMiddleware(db), controllers.RevokeAPIKey(db))
+	router.GET("/sessions", middleware.AuthMiddleware(db), middleware.NoAPIKeyMiddleware(), controllers.GetSessions(db))
+	router.DELETE("/sessions", middleware.AuthMiddleware(db), middleware.NoAPIKeyMiddleware(), controllers.RevokeAllSessions(db))
+	router.DELETE("/sessions/:id", middleware.AuthMiddleware(db), middleware.NoAPIKeyMiddleware(), controllers.RevokeSession(db))
 }
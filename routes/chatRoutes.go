@@ -2,17 +2,41 @@ package routes
 
 import (
 	"database/sql"
+	"log"
 
 	"online-learning-golang/chat"
 	"online-learning-golang/controllers"
+	"online-learning-golang/middleware"
 
 	"github.com/gin-gonic/gin"
 )
 
 func ChatRoutes(router *gin.RouterGroup, db *sql.DB) {
-	manager := chat.NewManager()
+	broker, err := chat.NewBrokerFromEnv()
+	if err != nil {
+		log.Fatalf("Error creating chat broker: %v", err)
+	}
+
+	manager := chat.NewManager(db, broker)
+	if err := manager.Subscribe(); err != nil {
+		log.Fatalf("Error subscribing to chat broker: %v", err)
+	}
 	go manager.Run()
 
-	router.GET("/ws", controllers.HandleWebSocket(manager))
-	router.GET("/history", controllers.GetChatHistory(db))
+	router.GET("/ws", middleware.WebSocketAuthMiddleware(db), controllers.HandleWebSocket(manager))
+	router.POST("/ticket", middleware.AuthMiddleware(db), controllers.CreateChatTicket(db))
+	router.POST("/attachments", middleware.AuthMiddleware(db), controllers.UploadChatAttachment(db))
+	router.GET("/search", middleware.AuthMiddleware(db), controllers.SearchChatMessages(db))
+	router.GET("/messages/:id/context", middleware.AuthMiddleware(db), controllers.GetChatMessageContext(db))
+	router.GET("/messages/:id/thread", middleware.AuthMiddleware(db), controllers.GetChatThread(db))
+	router.GET("/rooms", middleware.AuthMiddleware(db), controllers.GetChatRooms(db))
+	router.GET("/history", middleware.AuthMiddleware(db), controllers.GetChatHistory(db))
+	router.GET("/online", middleware.AuthMiddleware(db), controllers.GetOnlineUsers(db, manager))
+	router.GET("/read-states", middleware.AuthMiddleware(db), controllers.GetReadStates(db))
+	router.GET("/conversations", middleware.AuthMiddleware(db), controllers.GetConversations(db))
+	router.GET("/conversations/:userId/messages", middleware.AuthMiddleware(db), controllers.GetConversationMessages(db))
+	router.GET("/export", middleware.OnlyAdminMiddleware(db), controllers.ExportChatTranscript(db))
+	router.GET("/sanctions", middleware.OnlyAdminMiddleware(db), controllers.GetChatSanctions(db))
+	router.POST("/sanctions", middleware.OnlyAdminMiddleware(db), controllers.CreateChatSanction(db, manager))
+	router.DELETE("/sanctions/:id", middleware.OnlyAdminMiddleware(db), controllers.LiftChatSanction(db))
 }
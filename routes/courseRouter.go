@@ -10,9 +10,9 @@ import (
 
 func CourseRoutes(router *gin.RouterGroup, db *sql.DB) {
 	router.GET("/", controllers.GetCourses(db))
-	router.GET("/:id", middleware.AuthMiddleware(), controllers.GetCourse(db))
-	router.POST("/", middleware.OnlyAdminMiddleware(), controllers.CreateCourse(db))
-	router.POST("/activate", middleware.OnlyAdminMiddleware(), controllers.ActivateCourseForUser(db))
-	router.PUT("/:id", middleware.OnlyAdminMiddleware(), controllers.UpdateCourse(db))
-	router.DELETE("/:id", middleware.OnlyAdminMiddleware(), controllers.DeleteCourse(db))
+	router.GET("/:id", middleware.AuthMiddleware(db), controllers.GetCourse(db))
+	router.POST("/", middleware.OnlyAdminMiddleware(db), controllers.CreateCourse(db))
+	router.POST("/activate", middleware.OnlyAdminMiddleware(db), controllers.ActivateCourseForUser(db))
+	router.PUT("/:id", middleware.OnlyAdminMiddleware(db), controllers.UpdateCourse(db))
+	router.DELETE("/:id", middleware.OnlyAdminMiddleware(db), controllers.DeleteCourse(db))
 }
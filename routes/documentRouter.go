@@ -11,7 +11,7 @@ import (
 func DocumentRoutes(router *gin.RouterGroup, db *sql.DB) {
 	router.GET("/", controllers.GetDocuments(db))
 	router.GET("/classes", controllers.GetListClass(db))
-	router.POST("/", middleware.AuthMiddleware(), controllers.CreateDocument(db))
-	router.PUT("/:id", middleware.AuthMiddleware(), controllers.UpdateDocument(db))
-	router.DELETE("/:id", middleware.AuthMiddleware(), controllers.DeleteDocument(db))
+	router.POST("/", middleware.AuthMiddleware(db), controllers.CreateDocument(db))
+	router.PUT("/:id", middleware.AuthMiddleware(db), controllers.UpdateDocument(db))
+	router.DELETE("/:id", middleware.AuthMiddleware(db), controllers.DeleteDocument(db))
 }
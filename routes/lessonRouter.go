@@ -9,7 +9,7 @@ import (
 )
 
 func LessonRoutes(router *gin.RouterGroup, db *sql.DB) {
-	router.POST("/", middleware.OnlyAdminMiddleware(), controllers.CreateLesson(db))
-	router.PUT("/:id", middleware.OnlyAdminMiddleware(), controllers.UpdateLesson(db))
-	router.DELETE("/:id", middleware.OnlyAdminMiddleware(), controllers.DeleteLesson(db))
+	router.POST("/", middleware.OnlyAdminMiddleware(db), controllers.CreateLesson(db))
+	router.PUT("/:id", middleware.OnlyAdminMiddleware(db), controllers.UpdateLesson(db))
+	router.DELETE("/:id", middleware.OnlyAdminMiddleware(db), controllers.DeleteLesson(db))
 }
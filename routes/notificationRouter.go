@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"database/sql"
+	"online-learning-golang/controllers"
+	"online-learning-golang/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func NotificationRoutes(router *gin.RouterGroup, db *sql.DB) {
+	router.GET("/", middleware.AuthMiddleware(db), controllers.GetNotifications(db))
+	router.PUT("/read", middleware.AuthMiddleware(db), controllers.MarkAllNotificationsRead(db))
+	router.PUT("/:id/read", middleware.AuthMiddleware(db), controllers.MarkNotificationRead(db))
+}
@@ -10,11 +10,13 @@ import (
 
 func UserRoutes(router *gin.RouterGroup, db *sql.DB) {
 	router.POST("/", controllers.CreateUser(db))
-	router.POST("/admin", middleware.AuthMiddleware(), controllers.CreateUserAdmin(db))
-	router.GET("/", middleware.AuthMiddleware(), controllers.GetUsers(db))
-	router.GET("/:id", middleware.AuthMiddleware(), controllers.GetUserByID(db))
-	router.PUT("/:id", middleware.AuthMiddleware(), controllers.UpdateUser(db))
-	router.PUT("/:id/password", middleware.AuthMiddleware(), controllers.UpdateUserPassword(db))
-	router.PUT("/:id/avatar", middleware.AuthMiddleware(), controllers.UpdateUserAvatar(db))
-	router.DELETE("/:id", middleware.OnlyAdminMiddleware(), controllers.DeleteUser(db))
+	router.POST("/admin", middleware.AuthMiddleware(db), controllers.CreateUserAdmin(db))
+	router.GET("/", middleware.AuthMiddleware(db), controllers.GetUsers(db))
+	router.GET("/:id", middleware.AuthMiddleware(db), controllers.GetUserByID(db))
+	router.PUT("/:id", middleware.AuthMiddleware(db), controllers.UpdateUser(db))
+	router.PUT("/:id/password", middleware.AuthMiddleware(db), controllers.UpdateUserPassword(db))
+	router.PUT("/:id/avatar", middleware.AuthMiddleware(db), controllers.UpdateUserAvatar(db))
+	router.DELETE("/:id", middleware.OnlyAdminMiddleware(db), controllers.DeleteUser(db))
+	router.GET("/:id/sessions", middleware.OnlyAdminMiddleware(db), controllers.GetUserSessions(db))
+	router.DELETE("/:id/sessions", middleware.OnlyAdminMiddleware(db), controllers.SignOutUser(db))
 }
@@ -0,0 +1,11 @@
+package routes
+
+import (
+	"online-learning-golang/controllers"
+
+	"github.com/gin-gonic/gin"
+)
+
+func WellKnownRoutes(router *gin.RouterGroup) {
+	router.GET("/jwks.json", controllers.GetJWKS())
+}
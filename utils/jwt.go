@@ -9,78 +9,156 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-func CreateToken(userId int, role string, expirationTime time.Duration) (string, int64, error) {
-	expiration := time.Now().Add(expirationTime)
-	var jwtKey = []byte(os.Getenv("JWT_KEY"))
-
-	claims := jwt.MapClaims{
-		"userId": strconv.Itoa(userId),
-		"role":   role,
-		"exp":    expiration.Unix(),
+// TokenType says what a token may be used for. A token is only accepted
+// where its type is expected, so a token minted for one purpose cannot be
+// replayed as another.
+type TokenType string
+
+const (
+	TokenTypeAccess TokenType = "access"
+	// TokenTypeMFA proves the password was checked. It can only be exchanged
+	// for access tokens together with a second factor.
+	TokenTypeMFA TokenType = "mfa"
+	// TokenTypeMFAEnrollment lets a user who must use 2FA but has not set it
+	// up yet reach the enrollment endpoints, and nothing else.
+	TokenTypeMFAEnrollment TokenType = "mfa_enrollment"
+)
+
+const defaultTokenIssuer = "online-learning-golang"
+
+// tokenAudiences is who each token type is meant for.
+var tokenAudiences = map[TokenType]string{
+	TokenTypeAccess:        "online-learning-api",
+	TokenTypeMFA:           "online-learning-mfa",
+	TokenTypeMFAEnrollment: "online-learning-mfa-enrollment",
+}
+
+// TokenClaims is what a valid token says about its bearer.
+type TokenClaims struct {
+	UserID    int
+	Role      string
+	SessionID string
+	ID        string
+	ExpiresAt time.Time
+}
+
+type jwtClaims struct {
+	Type      TokenType `json:"type"`
+	UserID    string    `json:"userId"`
+	Role      string    `json:"role,omitempty"`
+	SessionID string    `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func tokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return defaultTokenIssuer
+}
+
+func CreateToken(tokenType TokenType, userId int, role string, sessionID string, expirationTime time.Duration) (string, int64, error) {
+	audience, ok := tokenAudiences[tokenType]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown token type %q", tokenType)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenID, err := GenerateResetToken()
 	if err != nil {
 		return "", 0, err
 	}
-	return tokenString, int64(expirationTime.Seconds()), nil
-}
 
-func CreateAccessToken(userId int, role string) (string, int64, error) {
-	return CreateToken(userId, role, 24*time.Hour)
+	ring, err := activeKeyring()
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now()
+	claims := jwtClaims{
+		Type:      tokenType,
+		UserID:    strconv.Itoa(userId),
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer(),
+			Subject:   strconv.Itoa(userId),
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(expirationTime)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        tokenID[:32],
+		},
+	}
+
+	tokenString, err := ring.sign(claims)
+	if err != nil {
+		return "", 0, err
+	}
+	return tokenString, int64(expirationTime.Seconds()), nil
 }
 
-func CreateRefreshToken(userId int, role string) (string, int64, error) {
-	return CreateToken(userId, role, 30*24*time.Hour)
+// CreateAccessToken issues an access token tied to a session, so that
+// revoking the session also invalidates the token.
+func CreateAccessToken(userId int, role string, sessionID string) (string, int64, error) {
+	return CreateToken(TokenTypeAccess, userId, role, sessionID, 24*time.Hour)
 }
 
-func ValidToken(tokenString string) (int, string, error) {
-	var jwtKey = []byte(os.Getenv("JWT_KEY"))
+// ValidToken parses a token and checks its signature against the keyring, its
+// lifetime, its issuer, and that it is of the expected type and addressed to
+// that type's audience.
+func ValidToken(tokenString string, expected TokenType) (*TokenClaims, error) {
+	audience, ok := tokenAudiences[expected]
+	if !ok {
+		return nil, fmt.Errorf("unknown token type %q", expected)
+	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtKey, nil
-	})
+	ring, err := activeKeyring()
+	if err != nil {
+		return nil, err
+	}
 
+	claims := &jwtClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(ring.methods()))
+	token, err := parser.ParseWithClaims(tokenString, claims, ring.keyFunc)
 	if err != nil {
-		return 0, "", err
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Type != expected:
+		return nil, fmt.Errorf("expected a %s token, got %q", expected, claims.Type)
+	case !claims.VerifyIssuer(tokenIssuer(), true):
+		return nil, fmt.Errorf("unexpected token issuer")
+	case !claims.VerifyAudience(audience, true):
+		return nil, fmt.Errorf("token is not meant for this audience")
+	case !claims.VerifyExpiresAt(now, true):
+		return nil, fmt.Errorf("token has expired")
+	case !claims.VerifyIssuedAt(now, true), !claims.VerifyNotBefore(now, true):
+		return nil, fmt.Errorf("token is not valid yet")
+	case claims.ID == "":
+		return nil, fmt.Errorf("token has no ID")
+	}
+
+	// Kiểm tra và chuyển đổi kiểu dữ liệu của userId
+	userId, err := strconv.Atoi(claims.UserID)
+	if err != nil || claims.Subject != claims.UserID {
+		return nil, fmt.Errorf("invalid userId in token")
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if exp, ok := claims["exp"].(float64); ok {
-			if time.Now().Unix() > int64(exp) {
-				return 0, "", fmt.Errorf("token has expired")
-			}
-		}
-
-		// Kiểm tra và chuyển đổi kiểu dữ liệu của userId
-		var userId int
-		switch id := claims["userId"].(type) {
-		case string:
-			userIdInt, err := strconv.Atoi(id)
-			if err != nil {
-				return 0, "", fmt.Errorf("invalid userId in token")
-			}
-			userId = userIdInt
-		case float64:
-			userId = int(id)
-		default:
-			return 0, "", fmt.Errorf("userId not found in token")
-		}
-
-		// Kiểm tra role
-		var role string
-		if roleVal, ok := claims["role"].(string); ok {
-			role = roleVal
-		} else {
-			return 0, "", fmt.Errorf("role not found in token")
-		}
-
-		return userId, role, nil
+	// Kiểm tra role
+	if claims.Role == "" {
+		return nil, fmt.Errorf("role not found in token")
 	}
 
-	return 0, "", fmt.Errorf("invalid token")
+	return &TokenClaims{
+		UserID:    userId,
+		Role:      claims.Role,
+		SessionID: claims.SessionID,
+		ID:        claims.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
 }
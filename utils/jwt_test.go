@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// useTestKeyring makes the package sign and verify with a fresh RS256 key
+// for the duration of the test.
+func useTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key, err := newJWTKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	key.Private = private
+	ring := &Keyring{signing: key, keys: map[string]*jwtKey{key.ID: key}}
+
+	keyringOnce.Do(func() {})
+	previous, previousErr := keyring, keyringErr
+	keyring, keyringErr = ring, nil
+	t.Cleanup(func() { keyring, keyringErr = previous, previousErr })
+
+	return ring
+}
+
+// signTestClaims signs a valid token of the given type after letting mutate
+// change its claims.
+func signTestClaims(t *testing.T, ring *Keyring, tokenType TokenType, mutate func(*jwtClaims)) string {
+	t.Helper()
+
+	now := time.Now()
+	claims := jwtClaims{
+		Type:   tokenType,
+		UserID: "7",
+		Role:   "user",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer(),
+			Subject:   "7",
+			Audience:  jwt.ClaimStrings{tokenAudiences[tokenType]},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        "0123456789abcdef0123456789abcdef",
+		},
+	}
+	if mutate != nil {
+		mutate(&claims)
+	}
+
+	token, err := ring.sign(claims)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestValidTokenRejectsOtherTokenTypes(t *testing.T) {
+	useTestKeyring(t)
+
+	types := []TokenType{TokenTypeAccess, TokenTypeMFA, TokenTypeMFAEnrollment}
+	for _, issued := range types {
+		token, _, err := CreateToken(issued, 7, "user", "session", time.Hour)
+		if err != nil {
+			t.Fatalf("CreateToken(%s): %v", issued, err)
+		}
+
+		for _, expected := range types {
+			claims, err := ValidToken(token, expected)
+			if issued == expected {
+				if err != nil {
+					t.Errorf("%s token rejected by its own validator: %v", issued, err)
+				} else if claims.UserID != 7 || claims.Role != "user" || claims.ID == "" {
+					t.Errorf("%s token returned wrong claims: %+v", issued, claims)
+				}
+				continue
+			}
+			if err == nil {
+				t.Errorf("%s token accepted as a %s token", issued, expected)
+			}
+		}
+	}
+}
+
+func TestValidTokenRejectsTypeWithOtherAudience(t *testing.T) {
+	ring := useTestKeyring(t)
+
+	// An MFA token relabelled as an access token still carries the MFA audience
+	token := signTestClaims(t, ring, TokenTypeMFA, func(c *jwtClaims) {
+		c.Type = TokenTypeAccess
+	})
+	if _, err := ValidToken(token, TokenTypeAccess); err == nil {
+		t.Error("access token with the MFA audience was accepted")
+	}
+}
+
+func TestValidTokenRejectsBadClaims(t *testing.T) {
+	ring := useTestKeyring(t)
+
+	tests := []struct {
+		name   string
+		mutate func(*jwtClaims)
+	}{
+		{"wrong issuer", func(c *jwtClaims) { c.Issuer = "someone-else" }},
+		{"missing issuer", func(c *jwtClaims) { c.Issuer = "" }},
+		{"wrong audience", func(c *jwtClaims) { c.Audience = jwt.ClaimStrings{"another-api"} }},
+		{"missing audience", func(c *jwtClaims) { c.Audience = nil }},
+		{"missing jti", func(c *jwtClaims) { c.ID = "" }},
+		{"missing iat", func(c *jwtClaims) { c.IssuedAt = nil }},
+		{"missing nbf", func(c *jwtClaims) { c.NotBefore = nil }},
+		{"missing exp", func(c *jwtClaims) { c.ExpiresAt = nil }},
+		{"expired", func(c *jwtClaims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Hour))
+			c.NotBefore = c.IssuedAt
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+		}},
+		{"not valid yet", func(c *jwtClaims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour)) }},
+		{"issued in the future", func(c *jwtClaims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour)) }},
+		{"subject differs from user", func(c *jwtClaims) { c.Subject = "8" }},
+		{"missing role", func(c *jwtClaims) { c.Role = "" }},
+	}
+
+	if _, err := ValidToken(signTestClaims(t, ring, TokenTypeAccess, nil), TokenTypeAccess); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signTestClaims(t, ring, TokenTypeAccess, tt.mutate)
+			if _, err := ValidToken(token, TokenTypeAccess); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestValidTokenRejectsAlgorithmMismatch(t *testing.T) {
+	ring := useTestKeyring(t)
+
+	valid := signTestClaims(t, ring, TokenTypeAccess, nil)
+	parsed, _, err := jwt.NewParser().ParseUnverified(valid, &jwtClaims{})
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+
+	// Sign the same claims with HS256, using the published public key as the
+	// secret, under the RSA key's kid
+	publicDER, err := x509.MarshalPKIXPublicKey(ring.signing.Public)
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, parsed.Claims)
+	forged.Header["kid"] = ring.signing.ID
+	token, err := forged.SignedString(publicDER)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	if _, err := ValidToken(token, TokenTypeAccess); err == nil {
+		t.Error("HS256 token accepted by an RS256 keyring")
+	}
+}
+
+func TestValidTokenRejectsUnknownKey(t *testing.T) {
+	ring := useTestKeyring(t)
+	token := signTestClaims(t, ring, TokenTypeAccess, nil)
+
+	// Verify with a different keyring that does not know the signing key
+	useTestKeyring(t)
+	if _, err := ValidToken(token, TokenTypeAccess); err == nil {
+		t.Error("token signed with an unknown key was accepted")
+	}
+}
@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"online-learning-golang/models"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtKey is one key of the keyring. Only the signing key has a private half.
+type jwtKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.PrivateKey
+	Public  crypto.PublicKey
+	// Secret is set instead of a key pair for the legacy HS256 JWT_KEY.
+	Secret []byte
+}
+
+func (k *jwtKey) verificationKey() interface{} {
+	if k.Secret != nil {
+		return k.Secret
+	}
+	return k.Public
+}
+
+// Keyring holds the key new tokens are signed with and every key tokens are
+// still accepted from. To rotate, start signing with a new key and keep the
+// old public key in JWT_VERIFICATION_KEYS until tokens signed with it have
+// expired.
+type Keyring struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+}
+
+var (
+	keyring     *Keyring
+	keyringErr  error
+	keyringOnce sync.Once
+)
+
+// LoadKeyring reads the JWT keys from the environment. It is called on
+// startup so that a bad key stops the server instead of failing every login.
+//
+// JWT_SIGNING_KEY is the path to a PEM private key, RSA (signs RS256) or
+// Ed25519 (signs EdDSA). JWT_VERIFICATION_KEYS is a comma separated list of
+// PEM public keys that are still trusted. Key IDs are derived from the public
+// keys, so they stay the same across restarts and services. Without
+// JWT_SIGNING_KEY tokens are signed with the shared HS256 JWT_KEY, which only
+// this server can verify.
+func LoadKeyring() error {
+	keyringOnce.Do(func() {
+		keyring, keyringErr = newKeyringFromEnv()
+	})
+	return keyringErr
+}
+
+func activeKeyring() (*Keyring, error) {
+	if err := LoadKeyring(); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+func newKeyringFromEnv() (*Keyring, error) {
+	ring := &Keyring{keys: make(map[string]*jwtKey)}
+
+	signingPath := os.Getenv("JWT_SIGNING_KEY")
+	if signingPath == "" {
+		secret := os.Getenv("JWT_KEY")
+		if secret == "" {
+			return nil, fmt.Errorf("either JWT_SIGNING_KEY or JWT_KEY must be set")
+		}
+		log.Println("JWT_SIGNING_KEY is not set, signing tokens with the shared HS256 JWT_KEY")
+		ring.signing = &jwtKey{Method: jwt.SigningMethodHS256, Secret: []byte(secret)}
+		ring.keys[""] = ring.signing
+		return ring, nil
+	}
+
+	signing, err := loadPrivateKey(signingPath)
+	if err != nil {
+		return nil, err
+	}
+	ring.signing = signing
+	ring.keys[signing.ID] = signing
+
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ring.keys[key.ID]; !ok {
+			ring.keys[key.ID] = key
+		}
+	}
+
+	return ring, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM encoded", path)
+	}
+	return block, nil
+}
+
+func loadPrivateKey(path string) (*jwtKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var private crypto.PrivateKey
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type in %s", path)
+	}
+	key, err := newJWTKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key.Private = private
+	return key, nil
+}
+
+func loadPublicKey(path string) (*jwtKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	key, err := newJWTKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func newJWTKey(public crypto.PublicKey) (*jwtKey, error) {
+	var method jwt.SigningMethod
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("only RSA and Ed25519 keys are supported")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+
+	return &jwtKey{
+		ID:     hex.EncodeToString(sum[:8]),
+		Method: method,
+		Public: public,
+	}, nil
+}
+
+// methods lists the algorithms of the trusted keys, for the JWT parser.
+func (r *Keyring) methods() []string {
+	seen := make(map[string]bool)
+	methods := []string{}
+	for _, key := range r.keys {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+func (r *Keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.signing.Method, claims)
+	if r.signing.ID != "" {
+		token.Header["kid"] = r.signing.ID
+	}
+
+	if r.signing.Secret != nil {
+		return token.SignedString(r.signing.Secret)
+	}
+	return token.SignedString(r.signing.Private)
+}
+
+// keyFunc finds the key a token was signed with by its kid and makes sure
+// the token uses that key's algorithm.
+func (r *Keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verificationKey(), nil
+}
+
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// JWKS returns the public keys of the keyring as a JSON Web Key Set. The
+// shared HS256 secret is never published.
+func JWKS() (*models.JWKSet, error) {
+	ring, err := activeKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &models.JWKSet{Keys: []models.JWK{}}
+	for _, key := range ring.keys {
+		jwk := models.JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64URL(pub.N.Bytes())
+			jwk.E = base64URL(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64URL(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	return set, nil
+}
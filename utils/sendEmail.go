@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"html"
+	"net/url"
 	"online-learning-golang/models"
 	"os"
 
@@ -37,6 +39,84 @@ func SendResetEmail(userEmail, token string) error {
 	return nil
 }
 
+func SendVerificationEmail(userEmail, token string) error {
+	verifyLink := fmt.Sprintf("%s/verify-email/%s", os.Getenv("CLIENT_URL"), token)
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", fmt.Sprintf("Support Team <%s>", os.Getenv("SMTP_EMAIL")))
+	m.SetHeader("To", userEmail)
+	m.SetHeader("Subject", "Verify your email address")
+	m.SetBody("text/html", fmt.Sprintf("Click <a href='%s'>here</a> to verify your email address. The link expires in 24 hours.", verifyLink))
+
+	d := gomail.NewDialer(os.Getenv("SMTP_HOST"), 587, os.Getenv("SMTP_EMAIL"), os.Getenv("SMTP_PASSWORD"))
+
+	if err := d.DialAndSend(m); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func SendUnlockEmail(userEmail, token string) error {
+	unlockLink := fmt.Sprintf("%s/unlock-account/%s", os.Getenv("CLIENT_URL"), token)
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", fmt.Sprintf("Support Team <%s>", os.Getenv("SMTP_EMAIL")))
+	m.SetHeader("To", userEmail)
+	m.SetHeader("Subject", "Your account has been locked")
+	m.SetBody("text/html", fmt.Sprintf("There were too many failed attempts to log in to your account, so it has been locked for 30 minutes. If this was you, click <a href='%s'>here</a> to unlock it now. If it was not, consider changing your password.", unlockLink))
+
+	d := gomail.NewDialer(os.Getenv("SMTP_HOST"), 587, os.Getenv("SMTP_EMAIL"), os.Getenv("SMTP_PASSWORD"))
+
+	if err := d.DialAndSend(m); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func SendMagicLinkEmail(userEmail, token string) error {
+	loginLink := fmt.Sprintf("%s/magic-link/%s", os.Getenv("CLIENT_URL"), token)
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", fmt.Sprintf("Support Team <%s>", os.Getenv("SMTP_EMAIL")))
+	m.SetHeader("To", userEmail)
+	m.SetHeader("Subject", "Your login link")
+	m.SetBody("text/html", fmt.Sprintf("Click <a href='%s'>here</a> to log in. The link works once and expires in 15 minutes. If you did not ask to log in, you can ignore this email.", loginLink))
+
+	d := gomail.NewDialer(os.Getenv("SMTP_HOST"), 587, os.Getenv("SMTP_EMAIL"), os.Getenv("SMTP_PASSWORD"))
+
+	if err := d.DialAndSend(m); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func SendMentionEmail(userEmail, senderName, room string, messageID int, content string) error {
+	chatLink := fmt.Sprintf("%s/chat?room=%s&message=%d", os.Getenv("CLIENT_URL"), url.QueryEscape(room), messageID)
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", fmt.Sprintf("Support Team <%s>", os.Getenv("SMTP_EMAIL")))
+	m.SetHeader("To", userEmail)
+	m.SetHeader("Subject", fmt.Sprintf("%s mentioned you in chat", senderName))
+
+	body := fmt.Sprintf(`
+	<p><strong>%s</strong> mentioned you:</p>
+	<blockquote>%s</blockquote>
+	<p>Click <a href='%s'>here</a> to open the conversation.</p>
+	`, html.EscapeString(senderName), html.EscapeString(content), chatLink)
+	m.SetBody("text/html", body)
+
+	d := gomail.NewDialer(os.Getenv("SMTP_HOST"), 587, os.Getenv("SMTP_EMAIL"), os.Getenv("SMTP_PASSWORD"))
+
+	if err := d.DialAndSend(m); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func SendContactEmail(data models.Contact) error {
 	m := gomail.NewMessage()
 	m.SetHeader("From", fmt.Sprintf("Support Team <%s>", os.Getenv("SMTP_EMAIL")))